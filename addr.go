@@ -0,0 +1,29 @@
+package euphoria
+
+import (
+	"net"
+	"path"
+	"strings"
+)
+
+// MatchAddr tells if the host:port addr matches one of patterns. A pattern is a host:port
+// where both parts are globs, like "*.example.com:443" or "10.0.0.*:*".
+func MatchAddr(patterns []string, addr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	host = strings.ToLower(host)
+	for _, pattern := range patterns {
+		patternHost, patternPort, err := net.SplitHostPort(pattern)
+		if err != nil {
+			continue
+		}
+		hostMatch, _ := path.Match(strings.ToLower(patternHost), host)
+		portMatch, _ := path.Match(patternPort, port)
+		if hostMatch && portMatch {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,24 @@
+package euphoria
+
+import (
+	"testing"
+)
+
+func TestMatchAddr(t *testing.T) {
+	patterns := []string{"*.example.com:443", "10.0.0.*:*", "[::1]:22"}
+	cases := map[string]bool{
+		"www.example.com:443": true,
+		"WWW.Example.com:443": true,
+		"www.example.com:80":  false,
+		"example.com:443":     false,
+		"10.0.0.7:5432":       true,
+		"10.0.1.7:5432":       false,
+		"[::1]:22":            true,
+		"foo":                 false,
+	}
+	for addr, expect := range cases {
+		if MatchAddr(patterns, addr) != expect {
+			t.Fatalf("match %v, expect %v", addr, expect)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package euphoria
+
+import (
+	"crypto/subtle"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"strings"
+)
+
+const AuthScheme = "Bearer "
+
+// Authenticate wraps handler so that a request without one of tokens as its bearer token
+// gets 401 and never reaches handler. No tokens means no authentication.
+func Authenticate(tokens []string, handler http.HandlerFunc) http.HandlerFunc {
+	if len(tokens) == 0 {
+		return handler
+	}
+	return func(writer http.ResponseWriter, request *http.Request) {
+		token := request.Header.Get("Authorization")
+		if strings.HasPrefix(token, AuthScheme) {
+			token = strings.TrimPrefix(token, AuthScheme)
+			for _, allowed := range tokens {
+				if subtle.ConstantTimeCompare([]byte(token), []byte(allowed)) == 1 {
+					handler(writer, request)
+					return
+				}
+			}
+		}
+		logrus.WithField("Fm", "Authenticate").Warnf("unauthorized request from %v to %v", request.RemoteAddr, request.URL.Path)
+		writer.Header().Set("WWW-Authenticate", strings.TrimSpace(AuthScheme))
+		writer.WriteHeader(http.StatusUnauthorized)
+	}
+}
+
+// SetAuthToken adds token to header as bearer token, if there is one.
+func SetAuthToken(header http.Header, token string) {
+	if token == "" {
+		return
+	}
+	header.Set("Authorization", AuthScheme+token)
+}
@@ -0,0 +1,41 @@
+package euphoria
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthenticate(t *testing.T) {
+	ok := func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(http.StatusOK)
+	}
+	do := func(handler http.HandlerFunc, header string) int {
+		request := httptest.NewRequest(http.MethodGet, "/get", nil)
+		if header != "" {
+			request.Header.Set("Authorization", header)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+	// no tokens is no authentication
+	if code := do(Authenticate(nil, ok), ""); code != http.StatusOK {
+		t.Fatalf("code %v without tokens", code)
+	}
+	handler := Authenticate([]string{"foo", "bar"}, ok)
+	header := http.Header{}
+	SetAuthToken(header, "bar")
+	for auth, expect := range map[string]int{
+		"":                          http.StatusUnauthorized,
+		"Bearer baz":                http.StatusUnauthorized,
+		"Basic foo":                 http.StatusUnauthorized,
+		"foo":                       http.StatusUnauthorized,
+		"Bearer foo":                http.StatusOK,
+		header.Get("Authorization"): http.StatusOK,
+	} {
+		if code := do(handler, auth); code != expect {
+			t.Fatalf("code %v for %q, expect %v", code, auth, expect)
+		}
+	}
+}
@@ -3,16 +3,14 @@ package main
 import (
 	"flag"
 	"fmt"
-	"github.com/elazarl/goproxy"
 	"github.com/saisesai/euphoria"
 	"github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v3"
-	"net/http"
 	"os"
 )
 
 var argDebug = flag.Bool("debug", false, "debug mode")
-var argMode = flag.String("mode", "", "running mode: [client/server/http-proxy]")
+var argMode = flag.String("mode", "", "running mode: [client/server]")
 var argConfig = flag.String("config", "", "config file path")
 
 var L = logrus.WithField("Fm", "main")
@@ -20,7 +18,7 @@ var L = logrus.WithField("Fm", "main")
 func processArgs() {
 	flag.Parse()
 	var argErr = false
-	if *argMode != "client" && *argMode != "server" && *argMode != "http-proxy" {
+	if *argMode != "client" && *argMode != "server" {
 		L.Errorln("wrong arg [mode]!")
 		argErr = true
 	}
@@ -67,12 +65,4 @@ func main() {
 		fmt.Println(config)
 		euphoria.NewClient(config).Run()
 	}
-	if *argMode == "http-proxy" {
-		L.Info("http proxy listen at localhost:3003")
-		proxy := goproxy.NewProxyHttpServer()
-		if *argDebug {
-			proxy.Verbose = true
-		}
-		L.Fatal(http.ListenAndServe("localhost:3003", proxy))
-	}
 }
@@ -0,0 +1,153 @@
+package euphoria
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	CipherClient = "client"
+	CipherServer = "server"
+)
+
+// CipherMaxAge is how long a sealed batch is accepted after it was sealed.
+const CipherMaxAge = 5 * time.Minute
+
+var (
+	ErrCipherTampered = errors.New("sealed data is tampered")
+	ErrCipherExpired  = errors.New("sealed data is expired")
+	ErrCipherReplayed = errors.New("sealed data is replayed")
+)
+
+// IsCipherError tells if err is a rejection from EventCipher.Open.
+func IsCipherError(err error) bool {
+	return err == ErrCipherTampered || err == ErrCipherExpired || err == ErrCipherReplayed
+}
+
+// EventCipher seals encoded events of a session with AES-GCM under a pre-shared key. Opening
+// rejects data that was tampered, sealed by the same side or for another session, sealed too
+// long ago or before the cipher was made, or already opened. A side makes one cipher shared by
+// all its transports, so data is opened once whatever the transport it comes through.
+// A nil EventCipher passes data as it is.
+type EventCipher struct {
+	AEAD    cipher.AEAD
+	Side    string
+	Seen    map[string]int64
+	Swept   time.Time
+	Started time.Time // data sealed before is rejected, the nonces seen by a previous process are lost
+	Mutex   sync.Mutex
+}
+
+// NewEventCipher makes a cipher for side, either CipherClient or CipherServer. It returns nil
+// if key is empty.
+func NewEventCipher(key string, side string) (*EventCipher, error) {
+	if key == "" {
+		return nil, nil
+	}
+	sum := sha256.Sum256([]byte(key))
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &EventCipher{
+		AEAD:    aead,
+		Side:    side,
+		Seen:    make(map[string]int64),
+		Swept:   time.Now(),
+		Started: time.Now(),
+		Mutex:   sync.Mutex{},
+	}, nil
+}
+
+// peer is the side whose data this side opens.
+func (m *EventCipher) peer() string {
+	if m.Side == CipherClient {
+		return CipherServer
+	}
+	return CipherClient
+}
+
+// data is the associated data of what side seals for session.
+func (m *EventCipher) data(side string, session string) []byte {
+	return []byte(side + "/" + session)
+}
+
+// Seal encrypts b of session as nonce | sealed(timestamp | b).
+func (m *EventCipher) Seal(session string, b []byte) []byte {
+	if m == nil {
+		return b
+	}
+	nonce := make([]byte, m.AEAD.NonceSize())
+	_, _ = rand.Read(nonce)
+	plain := make([]byte, 8+len(b))
+	binary.BigEndian.PutUint64(plain, uint64(time.Now().UnixNano()))
+	copy(plain[8:], b)
+	return m.AEAD.Seal(nonce, nonce, plain, m.data(m.Side, session))
+}
+
+// Open decrypts b sealed by the peer side for session.
+func (m *EventCipher) Open(session string, b []byte) ([]byte, error) {
+	if m == nil {
+		return b, nil
+	}
+	size := m.AEAD.NonceSize()
+	if len(b) < size {
+		return nil, ErrCipherTampered
+	}
+	plain, err := m.AEAD.Open(nil, b[:size], b[size:], m.data(m.peer(), session))
+	if err != nil || len(plain) < 8 {
+		return nil, ErrCipherTampered
+	}
+	// check freshness
+	now := time.Now()
+	sealed := int64(binary.BigEndian.Uint64(plain))
+	age := now.Sub(time.Unix(0, sealed))
+	if age > CipherMaxAge || age < -CipherMaxAge || sealed < m.Started.UnixNano() {
+		return nil, ErrCipherExpired
+	}
+	m.Mutex.Lock()
+	defer m.Mutex.Unlock()
+	nonce := string(b[:size])
+	if _, exist := m.Seen[nonce]; exist {
+		return nil, ErrCipherReplayed
+	}
+	m.Seen[nonce] = sealed
+	// forget the nonces that would be rejected as expired anyway
+	if now.Sub(m.Swept) > CipherMaxAge {
+		for nonce, sealed := range m.Seen {
+			if now.Sub(time.Unix(0, sealed)) > CipherMaxAge {
+				delete(m.Seen, nonce)
+			}
+		}
+		m.Swept = now
+	}
+	return plain[8:], nil
+}
+
+// Encode encodes v and seals the result for session.
+func (m *EventCipher) Encode(kind string, session string, v any) (b []byte, err error) {
+	b, err = Encode(kind, v)
+	if err != nil {
+		return nil, err
+	}
+	return m.Seal(session, b), nil
+}
+
+// Decode opens b of session and decodes the result to v.
+func (m *EventCipher) Decode(kind string, session string, b []byte, v any) (err error) {
+	b, err = m.Open(session, b)
+	if err != nil {
+		return err
+	}
+	return Decode(kind, b, v)
+}
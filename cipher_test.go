@@ -0,0 +1,64 @@
+package euphoria
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestEventCipher(t *testing.T) {
+	client, err := NewEventCipher("foo", CipherClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, _ := NewEventCipher("foo", CipherServer)
+	other, _ := NewEventCipher("bar", CipherServer)
+	data := []byte{1, 2, 3}
+	// test open
+	sealed := client.Seal("s", data)
+	b, err := server.Open("s", sealed)
+	if err != nil || !bytes.Equal(b, data) {
+		t.Fatalf("open result: %v, %v", b, err)
+	}
+	// test replay
+	_, err = server.Open("s", sealed)
+	if err != ErrCipherReplayed {
+		t.Fatalf("expect %v, got %v", ErrCipherReplayed, err)
+	}
+	// test tamper
+	sealed = client.Seal("s", data)
+	sealed[len(sealed)-1] ^= 1
+	_, err = server.Open("s", sealed)
+	if err != ErrCipherTampered {
+		t.Fatalf("expect %v, got %v", ErrCipherTampered, err)
+	}
+	// test wrong key
+	_, err = other.Open("s", client.Seal("s", data))
+	if err != ErrCipherTampered {
+		t.Fatalf("expect %v, got %v", ErrCipherTampered, err)
+	}
+	// test reflection
+	_, err = client.Open("s", client.Seal("s", data))
+	if err != ErrCipherTampered {
+		t.Fatalf("expect %v, got %v", ErrCipherTampered, err)
+	}
+	// test another session
+	_, err = server.Open("t", client.Seal("s", data))
+	if err != ErrCipherTampered {
+		t.Fatalf("expect %v, got %v", ErrCipherTampered, err)
+	}
+	// test restart, data sealed before the cipher was made is rejected
+	sealed = client.Seal("s", data)
+	time.Sleep(time.Millisecond)
+	restarted, _ := NewEventCipher("foo", CipherServer)
+	_, err = restarted.Open("s", sealed)
+	if err != ErrCipherExpired {
+		t.Fatalf("expect %v, got %v", ErrCipherExpired, err)
+	}
+	// test passthrough
+	var none *EventCipher
+	b, err = none.Open("s", none.Seal("s", data))
+	if err != nil || !bytes.Equal(b, data) {
+		t.Fatalf("passthrough result: %v, %v", b, err)
+	}
+}
@@ -10,10 +10,19 @@ type ClientConfig struct {
 	Common struct {
 		EventEncode string `yaml:"EventEncode"`
 		BaseAddr    string `yaml:"BaseAddr"`
+		SessionId   string `yaml:"SessionId"`
+		Transport   string `yaml:"Transport"`
+		CipherKey   string `yaml:"CipherKey"`
 	} `yaml:"Common"`
+	Tls                TlsClientConfig          `yaml:"Tls"`
 	TcpInput           TcpInputConfig           `yaml:"TcpInput"`
+	TcpOutput          TcpOutputConfig          `yaml:"TcpOutput"`
+	UdpInput           UdpInputConfig           `yaml:"UdpInput"`
+	UdpOutput          UdpOutputConfig          `yaml:"UdpOutput"`
 	HttpEventRetriever HttpEventRetrieverConfig `yaml:"HttpEventRetriever"`
 	HttpEventSender    HttpEventSenderConfig    `yaml:"HttpEventSender"`
+	WsEventClient      WsEventClientConfig      `yaml:"WsEventClient"`
+	StreamEventClient  StreamEventClientConfig  `yaml:"StreamEventClient"`
 }
 
 func (m *ClientConfig) String() string {
@@ -26,24 +35,84 @@ type Client struct {
 	Logger             *logrus.Entry
 	HttpClient         *http.Client
 	TcpInput           *TcpInput
+	TcpOutput          *TcpOutput
+	UdpInput           *UdpInput
+	UdpOutput          *UdpOutput
+	EventRouter        *EventRouter
 	HttpEventRetriever *HttpEventRetriever
 	HttpEventSender    *HttpEventSender
+	WsEventClient      *WsEventClient
+	StreamEventClient  *StreamEventClient
 }
 
 func NewClient(config *ClientConfig) (client *Client) {
+	// every stage talks to the server within the same session
+	if config.Common.SessionId == "" {
+		config.Common.SessionId = NewSessionId()
+	}
+	config.HttpEventSender.SessionId = config.Common.SessionId
+	config.HttpEventRetriever.SessionId = config.Common.SessionId
+	config.WsEventClient.SessionId = config.Common.SessionId
+	config.StreamEventClient.SessionId = config.Common.SessionId
 	client = &Client{
 		Config:     config,
 		Logger:     logrus.WithField("Fm", "Client"),
 		HttpClient: &http.Client{},
 	}
-	client.HttpEventSender = NewHttpEventSender(&config.HttpEventSender, client.HttpClient)
+	// every transport shares the tls config of the http client
+	tlsConfig, err := NewClientTlsConfig(&config.Tls)
+	if err != nil {
+		client.Logger.WithError(err).Fatalln("failed to setup tls!")
+	}
+	if tlsConfig != nil {
+		// keep the timeouts and pooling of the default transport
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.Proxy = http.ProxyFromEnvironment
+		transport.TLSClientConfig = tlsConfig
+		client.HttpClient.Transport = transport
+	}
+	// every transport shares the cipher, so data opened by one is a replay to the others
+	cipher, err := NewEventCipher(config.Common.CipherKey, CipherClient)
+	if err != nil {
+		client.Logger.WithError(err).Fatalln("invalid cipher key!")
+	}
+	client.HttpEventSender = NewHttpEventSender(&config.HttpEventSender, client.HttpClient, cipher)
 	client.TcpInput = NewTcpInput(&config.TcpInput, client.HttpEventSender)
-	client.HttpEventRetriever = NewHttpEventRetriever(&config.HttpEventRetriever, client.HttpClient, client.TcpInput)
+	// the output dials the conns of tunnels listening on the server
+	client.TcpOutput = NewTcpOutput(&config.TcpOutput, client.HttpEventSender)
+	client.UdpInput = NewUdpInput(&config.UdpInput, client.HttpEventSender)
+	client.UdpOutput = NewUdpOutput(&config.UdpOutput, client.HttpEventSender)
+	client.EventRouter = NewTunnelEventRouter(client.TcpInput, client.TcpOutput, client.UdpInput, client.UdpOutput)
+	client.HttpEventRetriever = NewHttpEventRetriever(&config.HttpEventRetriever, client.HttpClient, client.EventRouter, cipher)
+	// the websocket and stream transports drain the same queue as the sender
+	client.WsEventClient = NewWsEventClient(&config.WsEventClient, client.HttpClient, client.HttpEventSender, client.EventRouter, cipher)
+	client.StreamEventClient = NewStreamEventClient(&config.StreamEventClient, client.HttpClient, client.HttpEventSender, client.EventRouter, cipher)
+	// a restarted server lost the conns of the session, resuming them closes the ones it does not know
+	epoch := NewEventEpoch()
+	epoch.OnChange = func() {
+		client.TcpInput.Resume("")
+		client.TcpOutput.Resume(config.Common.SessionId)
+	}
+	client.HttpEventRetriever.Epoch = epoch
+	client.WsEventClient.Epoch = epoch
+	client.StreamEventClient.Epoch = epoch
 	return client
 }
 
 func (m *Client) Run() {
-	go m.HttpEventSender.Run()
+	// start from a clean session, whatever a previous process left on the server is dropped
+	m.HttpEventRetriever.Clear()
 	go m.TcpInput.Run()
+	go m.TcpOutput.Run()
+	go m.UdpInput.Run()
+	go m.UdpOutput.Run()
+	switch m.Config.Common.Transport {
+	case "websocket":
+		err := m.WsEventClient.Run()
+		m.Logger.WithError(err).Warn("fall back to polling transport!")
+	case "stream":
+		m.StreamEventClient.Run()
+	}
+	go m.HttpEventSender.Run()
 	m.HttpEventRetriever.Run()
 }
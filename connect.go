@@ -1,12 +1,291 @@
 package euphoria
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"math"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+var ErrPendingOverflow = errors.New("too many events pending")
+
+// UnlimitedWindow is the most credit a conn holds, so grants never overflow it.
+const UnlimitedWindow = math.MaxInt64 / 2
+
+// DefaultWindow is the window of a stage configured without one, a conn never buffers an
+// unlimited number of bytes for its peer.
+const DefaultWindow = 256 * 1024
+
+// AckInterval is the number of events received by a conn after which it acknowledges them even
+// if it has nothing to send.
+const AckInterval = 64
+
+// Data of the TcpResume events.
+const (
+	ResumeRequest = 0x00 // the peer retransmits and answers with its own position
+	ResumeReply   = 0x01 // the peer only retransmits
+)
+
+// Connect is a tunnelled conn. From is its id and To the id of its peer on the other side, the
+// ids are random so events never carry the addresses of the conns.
 type Connect struct {
-	Conn  net.Conn
-	From  string
-	To    string
-	Ready chan bool
+	Conn     net.Conn
+	Addr     string // address of the other end of Conn, for logging only
+	From     string
+	To       string
+	Session  string
+	Ready    chan error        // receives nil once the peer is opened, or why it failed
+	SendSeq  uint64            // last sequence number stamped on outgoing events
+	RecvSeq  uint64            // last sequence number delivered in order
+	Pending  map[uint64]*Event // incoming events waiting for a gap to be filled
+	Held     int               // size of the pending events, one more than the bytes of each
+	Unacked  []*Event          // outgoing events the peer did not acknowledge yet, for replay
+	Received int               // events received since the last acknowledgement sent
+	Context  context.Context   // done once the conn is closed
+	cancel   context.CancelFunc
+	Writes   EventQueueImpl // events to write to the conn, in order, off the event loop
+	// flow control, the peer grants the bytes it accepts in window events
+	Credit   int64 // bytes the peer still accepts from the conn
+	Consumed int64 // bytes written to the conn not granted back to the peer yet
+	// half close, the conn is closed once it is done both ways
+	readDone  bool
+	writeDone bool
+	LastSeen  int64 // unix nano of the last write to the conn
+	mutex     sync.Mutex
+	granted   chan struct{}
+}
+
+func NewConnect(conn net.Conn, from string, to string) *Connect {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Connect{
+		Conn:     conn,
+		Addr:     "",
+		From:     from,
+		To:       to,
+		Session:  "",
+		Ready:    make(chan error, 1),
+		SendSeq:  0,
+		RecvSeq:  0,
+		Pending:  make(map[uint64]*Event),
+		Context:  ctx,
+		cancel:   cancel,
+		Credit:   0,
+		LastSeen: time.Now().UnixNano(),
+		granted:  make(chan struct{}),
+	}
+}
+
+// NewConnectId makes a random id for a conn.
+func NewConnectId() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Close closes the conn and ends its context.
+func (m *Connect) Close() {
+	m.cancel()
+	m.Conn.Close()
+}
+
+// Touch marks the conn as written to.
+func (m *Connect) Touch() {
+	atomic.StoreInt64(&m.LastSeen, time.Now().UnixNano())
+}
+
+// Idle tells if nothing was written to the conn for timeout.
+func (m *Connect) Idle(timeout time.Duration) bool {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&m.LastSeen))) > timeout
+}
+
+// CloseRead records the conn read to its end, it tells if the conn is done both ways.
+func (m *Connect) CloseRead() bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.readDone = true
+	return m.writeDone
+}
+
+// CloseWrite shuts down the writing side of the conn once the peer is read to its end, it tells
+// if the conn is done both ways. A conn that can not be half closed is done at once.
+func (m *Connect) CloseWrite() bool {
+	m.mutex.Lock()
+	m.writeDone = true
+	done := m.readDone
+	m.mutex.Unlock()
+	conn, ok := m.Conn.(interface{ CloseWrite() error })
+	if done || !ok {
+		return true
+	}
+	return conn.CloseWrite() != nil
+}
+
+// Stamp gives event the session, the next outgoing sequence number of the connect and the
+// acknowledgement of the events received. The event is kept for replay until the peer acknowledges it.
+func (m *Connect) Stamp(event *Event) *Event {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.SendSeq++
+	event.Ss = m.Session
+	event.Sq = m.SendSeq
+	event.Ak = m.Ack()
+	m.Unacked = append(m.Unacked, event)
+	m.Received = 0
+	return event
+}
+
+// Ack is the last sequence number received in order.
+func (m *Connect) Ack() uint64 {
+	return atomic.LoadUint64(&m.RecvSeq)
+}
+
+// Acknowledge drops the events the peer received up to ack from the replay buffer.
+func (m *Connect) Acknowledge(ack uint64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	i := 0
+	for i < len(m.Unacked) && m.Unacked[i].Sq <= ack {
+		i++
+	}
+	m.Unacked = m.Unacked[i:]
+}
+
+// Replay returns copies of the events the peer did not acknowledge, carrying the current ack.
+func (m *Connect) Replay() []*Event {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	events := make([]*Event, 0, len(m.Unacked))
+	for _, event := range m.Unacked {
+		replay := *event
+		replay.Ak = m.Ack()
+		events = append(events, &replay)
+	}
+	return events
+}
+
+// AckDue tells if AckInterval events were received since the last acknowledgement sent.
+func (m *Connect) AckDue() bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.Received >= AckInterval
+}
+
+// Accept takes an incoming event and returns the events that can be delivered in order.
+// Duplicates are dropped and early events are held back until the events before them arrive.
+// The peer sends at most window bytes ahead, the conn fails with ErrPendingOverflow once the
+// events held back are larger than twice the window.
+func (m *Connect) Accept(event *Event, window int) ([]*Event, error) {
+	m.Acknowledge(event.Ak)
+	if event.Sq == 0 {
+		return []*Event{event}, nil
+	}
+	if event.Sq <= m.RecvSeq {
+		return nil, nil
+	}
+	if event.Sq > m.RecvSeq+1 {
+		if _, exist := m.Pending[event.Sq]; !exist {
+			m.Held += len(event.Dt) + 1
+		}
+		m.Pending[event.Sq] = event
+		if m.Held > 2*WindowSize(window) {
+			return nil, ErrPendingOverflow
+		}
+		return nil, nil
+	}
+	events := []*Event{event}
+	atomic.StoreUint64(&m.RecvSeq, event.Sq)
+	for {
+		next, exist := m.Pending[m.RecvSeq+1]
+		if !exist {
+			break
+		}
+		delete(m.Pending, next.Sq)
+		m.Held -= len(next.Dt) + 1
+		events = append(events, next)
+		atomic.StoreUint64(&m.RecvSeq, next.Sq)
+	}
+	m.mutex.Lock()
+	m.Received += len(events)
+	m.mutex.Unlock()
+	return events, nil
+}
+
+// Grant adds n bytes to the credit of the conn.
+func (m *Connect) Grant(n int64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.Credit += n
+	if m.Credit > UnlimitedWindow {
+		m.Credit = UnlimitedWindow
+	}
+	close(m.granted)
+	m.granted = make(chan struct{})
+}
+
+// Spend takes n bytes sent to the peer from the credit of the conn.
+func (m *Connect) Spend(n int64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.Credit -= n
+}
+
+// WaitCredit blocks until the peer accepts more bytes and returns how many, or 0 once the conn is closed.
+func (m *Connect) WaitCredit() int64 {
+	for {
+		m.mutex.Lock()
+		credit := m.Credit
+		granted := m.granted
+		m.mutex.Unlock()
+		if credit > 0 {
+			return credit
+		}
+		select {
+		case <-granted:
+		case <-m.Context.Done():
+			return 0
+		}
+	}
+}
+
+// Consume counts n bytes written to the conn, it returns the bytes to grant back to the peer
+// once half of window is consumed, or 0 if it is not time yet.
+func (m *Connect) Consume(n int, window int) int64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.Consumed += int64(n)
+	if m.Consumed < int64(window/2) {
+		return 0
+	}
+	grant := m.Consumed
+	m.Consumed = 0
+	return grant
+}
+
+// WindowSize is the window of a stage configured with window, DefaultWindow if it is 0.
+func WindowSize(window int) int {
+	if window <= 0 {
+		return DefaultWindow
+	}
+	return window
+}
+
+// EncodeWindow makes the data of a window event granting n bytes.
+func EncodeWindow(n int64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(n))
+	return b
+}
+
+// DecodeWindow reads the bytes granted by a window event.
+func DecodeWindow(b []byte) int64 {
+	if len(b) != 8 {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(b) & math.MaxInt64)
 }
@@ -0,0 +1,199 @@
+package euphoria
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnectAccept(t *testing.T) {
+	connect := NewConnect(nil, "foo", "bar")
+	connect.RecvSeq = 1
+	var delivered []uint64
+	for _, sq := range []uint64{2, 4, 2, 5, 3, 4, 6} {
+		events, err := connect.Accept(&Event{Nm: "TcpData", Sq: sq}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, event := range events {
+			delivered = append(delivered, event.Sq)
+		}
+	}
+	expect := []uint64{2, 3, 4, 5, 6}
+	if len(delivered) != len(expect) {
+		t.Fatalf("delivered %v, expect %v", delivered, expect)
+	}
+	for i := range expect {
+		if delivered[i] != expect[i] {
+			t.Fatalf("delivered %v, expect %v", delivered, expect)
+		}
+	}
+	if len(connect.Pending) != 0 || connect.Held != 0 {
+		t.Fatalf("%v events left pending", len(connect.Pending))
+	}
+	// a peer sending far beyond the window behind a gap fails the conn
+	for sq := uint64(8); sq < 28; sq++ {
+		if _, err := connect.Accept(&Event{Nm: "TcpData", Sq: sq, Dt: make([]byte, 99)}, 1000); err != nil {
+			t.Fatalf("event %v within twice the window: %v", sq, err)
+		}
+	}
+	if _, err := connect.Accept(&Event{Nm: "TcpData", Sq: 28, Dt: make([]byte, 99)}, 1000); err != ErrPendingOverflow {
+		t.Fatalf("event beyond twice the window: %v", err)
+	}
+}
+
+func TestConnectWindow(t *testing.T) {
+	connect := NewConnect(nil, "foo", "bar")
+	connect.Grant(DecodeWindow(EncodeWindow(100)))
+	connect.Spend(60)
+	if credit := connect.WaitCredit(); credit != 40 {
+		t.Fatalf("credit %v, expect 40", credit)
+	}
+	// the consumed bytes are granted back once half of the window is consumed
+	if grant := connect.Consume(30, 100); grant != 0 {
+		t.Fatalf("grant %v before half of the window", grant)
+	}
+	if grant := connect.Consume(30, 100); grant != 60 {
+		t.Fatalf("grant %v, expect 60", grant)
+	}
+	connect.cancel()
+	connect.Spend(40)
+	if credit := connect.WaitCredit(); credit != 0 {
+		t.Fatalf("credit %v of a closed conn", credit)
+	}
+}
+
+func TestConnectReplay(t *testing.T) {
+	connect := NewConnect(nil, "foo", "bar")
+	for i := 0; i < 3; i++ {
+		connect.Stamp(&Event{Nm: "TcpData"})
+	}
+	// the peer received the first two events and sends its first one
+	_, _ = connect.Accept(&Event{Nm: "TcpData", Sq: 1, Ak: 2}, 0)
+	replay := connect.Replay()
+	if len(replay) != 1 || replay[0].Sq != 3 || replay[0].Ak != 1 {
+		t.Fatalf("invalid replay: %v", replay)
+	}
+	if replay[0] == connect.Unacked[0] {
+		t.Fatal("replay is not a copy")
+	}
+}
+
+func TestConnectHalfClose(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	connect := NewConnect(conn, "foo", "bar")
+	defer connect.Close()
+	// the peer reads the end of the conn, which is still open for reading
+	if connect.CloseWrite() {
+		t.Fatal("conn is done before it is read to its end")
+	}
+	if _, err = peer.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("peer reads %v instead of eof", err)
+	}
+	if _, err = peer.Write([]byte{1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = conn.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if !connect.CloseRead() {
+		t.Fatal("conn is not done both ways")
+	}
+}
+
+func TestConnectHalfCloseAbort(t *testing.T) {
+	// the destination streams to its conns until they are closed
+	dest, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dest.Close()
+	stream := make(chan bool, 1)
+	go func() {
+		for {
+			conn, err := dest.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn, write bool) {
+				defer conn.Close()
+				b := make([]byte, 16*1024)
+				for write {
+					if _, err := conn.Write(b); err != nil {
+						return
+					}
+				}
+				_, _ = io.Copy(io.Discard, conn)
+			}(conn, <-stream)
+		}
+	}()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// open opens a half closed conn through a tunnel, it returns a check that the conn is closed on
+	// both sides
+	open := func(write bool, shutdownTimeout int) (*net.TCPConn, func()) {
+		inputOut := &EventQueueImpl{}
+		outputOut := &EventQueueImpl{}
+		input := NewTcpInput(&TcpInputConfig{ListenAddr: "127.0.0.1:0", ReadBufferSize: 1024, OpenTimeout: 1000, ShutdownTimeout: shutdownTimeout}, inputOut)
+		output := NewTcpOutput(&TcpOutputConfig{DestAddr: dest.Addr().String(), ReadBufferSize: 1024}, outputOut)
+		go input.Run()
+		go output.Run()
+		go pump(ctx, inputOut, output)
+		go pump(ctx, outputOut, input)
+		stream <- write
+		conn, err := net.Dial("tcp", input.Tunnels[0].Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.(*net.TCPConn).CloseWrite()
+		return conn.(*net.TCPConn), func() {
+			deadline := time.Now().Add(time.Second)
+			for {
+				input.RegistryMutex.RLock()
+				inputs := len(input.Registry)
+				input.RegistryMutex.RUnlock()
+				output.RegistryMutex.RLock()
+				outputs := len(output.Registry)
+				output.RegistryMutex.RUnlock()
+				if inputs == 0 && outputs == 0 {
+					return
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("%v input and %v output conns left", inputs, outputs)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+	}
+	// the local client aborts mid-download, the failed write closes the conn on both sides
+	conn, closed := open(true, 60000)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = io.ReadFull(conn, make([]byte, 64*1024)); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	closed()
+	// a half closed conn the destination writes nothing to is closed after ShutdownTimeout
+	conn, closed = open(false, 100)
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("idle half closed conn is not closed: %v", err)
+	}
+	closed()
+}
@@ -1,9 +1,12 @@
 package euphoria
 
 import (
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"github.com/vmihailenco/msgpack/v5"
+	"io"
+	"strconv"
 )
 
 func Encode(kind string, v any) (b []byte, err error) {
@@ -27,3 +30,67 @@ func Decode(kind string, b []byte, v any) (err error) {
 		return errors.New("unknown encoding: " + kind)
 	}
 }
+
+// EventOverhead is an upper bound of the encoded size of an event besides its strings and data.
+const EventOverhead = 160
+
+// BatchOverhead is an upper bound of the size a batch adds to its encoded and sealed events.
+const BatchOverhead = 128
+
+// EncodedSize estimates the encoded size of event as kind, it is an upper bound for the
+// encodings supported.
+func EncodedSize(kind string, event *Event) int {
+	size := len(event.Nm) + len(event.To) + len(event.Fm) + len(event.Ss) + EventOverhead
+	if kind == "application/json" {
+		// data is encoded as base64
+		return size + (len(event.Dt)+2)/3*4
+	}
+	return size + len(event.Dt)
+}
+
+// MaxBatchBytes is the limit of the encoded events of a batch whose whole encoded and sealed
+// size must stay within maxBytes, 0 is no limit.
+func MaxBatchBytes(maxBytes int) int {
+	if maxBytes <= 0 {
+		return 0
+	}
+	if maxBytes <= BatchOverhead {
+		return 1
+	}
+	return maxBytes - BatchOverhead
+}
+
+// MaxFrameSize limits the size of a frame read from a stream.
+const MaxFrameSize = 64 << 20
+
+// WriteFrame writes v to w as a frame, the encoded and sealed data prefixed with its length.
+func WriteFrame(w io.Writer, cipher *EventCipher, session string, kind string, v any) (err error) {
+	b, err := cipher.Encode(kind, session, v)
+	if err != nil {
+		return err
+	}
+	frame := make([]byte, 4+len(b))
+	binary.BigEndian.PutUint32(frame, uint32(len(b)))
+	copy(frame[4:], b)
+	_, err = w.Write(frame)
+	return err
+}
+
+// ReadFrame reads a frame written by WriteFrame from r and decodes it to v.
+func ReadFrame(r io.Reader, cipher *EventCipher, session string, kind string, v any) (err error) {
+	var size [4]byte
+	_, err = io.ReadFull(r, size[:])
+	if err != nil {
+		return err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > MaxFrameSize {
+		return errors.New("frame too large: " + strconv.Itoa(int(n)))
+	}
+	b := make([]byte, n)
+	_, err = io.ReadFull(r, b)
+	if err != nil {
+		return err
+	}
+	return cipher.Decode(kind, session, b, v)
+}
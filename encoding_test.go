@@ -1,7 +1,9 @@
 package euphoria
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"testing"
 	"time"
 )
@@ -38,3 +40,35 @@ func TestEncode(t *testing.T) {
 	}
 	fmt.Println("decode result:", eds[0], eds[1])
 }
+
+func TestFrame(t *testing.T) {
+	var err error
+	kind := "application/msgpack"
+	buf := &bytes.Buffer{}
+	// test write
+	for i := 1; i <= 3; i++ {
+		frame := &EventFrame{
+			Ck: uint64(i),
+			Ev: []*Event{{Nm: "TcpData", Sq: uint64(i), Dt: []byte{byte(i)}}},
+		}
+		err = WriteFrame(buf, nil, "", kind, frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// test read
+	for i := 1; i <= 3; i++ {
+		var frame EventFrame
+		err = ReadFrame(buf, nil, "", kind, &frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frame.Ck != uint64(i) || len(frame.Ev) != 1 || frame.Ev[0].Dt[0] != byte(i) {
+			t.Fatalf("unexpected frame %v: %v", i, frame)
+		}
+	}
+	err = ReadFrame(buf, nil, "", kind, &EventFrame{})
+	if err != io.EOF {
+		t.Fatalf("expect EOF, got %v", err)
+	}
+}
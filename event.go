@@ -5,5 +5,16 @@ type Event struct {
 	To string // To
 	Fm string // From
 	Tm int64  // Time
+	Sq uint64 // Sequence, per connection, 0 means unsequenced
+	Ak uint64 // Ack, last sequence number of the connection the sender received in order
+	Ss string // Session
+	Rp bool   // Reply, sent on behalf of a dialed conn to the side that accepted it
 	Dt []byte // Data
 }
+
+// EventFrame carries a batch of events over a long-lived connection. Ck is the cursor of the
+// batch when sent by the server, and the last cursor received when sent by the client.
+type EventFrame struct {
+	Ck uint64   // Cursor or ack
+	Ev []*Event // Events
+}
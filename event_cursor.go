@@ -0,0 +1,48 @@
+package euphoria
+
+import (
+	"context"
+	"sync"
+)
+
+// EventCursor is the cursor of the last batch a client received, storing it wakes up the
+// sender waiting to ack it.
+type EventCursor struct {
+	mutex sync.Mutex
+	value uint64
+	wake  context.CancelFunc
+}
+
+func (m *EventCursor) Load() uint64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.value
+}
+
+func (m *EventCursor) Store(cursor uint64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.value = cursor
+	if m.wake != nil {
+		m.wake()
+	}
+}
+
+// Wait blocks until source is not empty or the cursor moves past acked, it returns false if
+// ctx is done first.
+func (m *EventCursor) Wait(ctx context.Context, source EventQueue, acked uint64) bool {
+	wait, cancel := context.WithCancel(ctx)
+	defer cancel()
+	m.mutex.Lock()
+	if m.value != acked {
+		m.mutex.Unlock()
+		return true
+	}
+	m.wake = cancel
+	m.mutex.Unlock()
+	source.Wait(wait)
+	m.mutex.Lock()
+	m.wake = nil
+	m.mutex.Unlock()
+	return ctx.Err() == nil
+}
@@ -0,0 +1,31 @@
+package euphoria
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestEventCursorWait(t *testing.T) {
+	cursor := &EventCursor{}
+	queue := &EventQueueImpl{}
+	// a cursor stored before the wait is not missed
+	cursor.Store(1)
+	if !cursor.Wait(context.Background(), queue, 0) {
+		t.Fatal("cursor stored before the wait is missed")
+	}
+	// a cursor stored during the wait wakes it up
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cursor.Store(2)
+	}()
+	if !cursor.Wait(context.Background(), queue, 1) {
+		t.Fatal("wait is not woken up by store")
+	}
+	// wait gives up once ctx is done
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if cursor.Wait(ctx, queue, 2) {
+		t.Fatal("wait does not give up")
+	}
+}
@@ -0,0 +1,59 @@
+package euphoria
+
+import (
+	"errors"
+	"github.com/sirupsen/logrus"
+	"sync"
+)
+
+var ErrServerRestarted = errors.New("server restarted")
+
+// EventEpoch is the epoch of the server a client talks to, the server sends it along with the
+// events it delivers. A new epoch means the server restarted and lost the conns of the session,
+// OnChange is then called so the client resumes its conns and the ones the server lost are closed.
+type EventEpoch struct {
+	Logger   *logrus.Entry
+	OnChange func()
+	mutex    sync.Mutex
+	value    string
+}
+
+func NewEventEpoch() *EventEpoch {
+	return &EventEpoch{
+		Logger:   logrus.WithField("Fm", "EventEpoch"),
+		OnChange: nil,
+	}
+}
+
+// Value is the last epoch observed, empty if none.
+func (m *EventEpoch) Value() string {
+	if m == nil {
+		return ""
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.value
+}
+
+// Changed tells if epoch is another one than the epoch observed before.
+func (m *EventEpoch) Changed(epoch string) bool {
+	value := m.Value()
+	return epoch != "" && value != "" && value != epoch
+}
+
+// Observe records the epoch of a response, an empty epoch is ignored.
+func (m *EventEpoch) Observe(epoch string) {
+	if m == nil || epoch == "" {
+		return
+	}
+	m.mutex.Lock()
+	changed := m.value != "" && m.value != epoch
+	m.value = epoch
+	m.mutex.Unlock()
+	if changed {
+		m.Logger.Warnf("server restarted with epoch %v, resume conns!", epoch)
+		if m.OnChange != nil {
+			m.OnChange()
+		}
+	}
+}
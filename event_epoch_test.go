@@ -0,0 +1,72 @@
+package euphoria
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestEventEpochRestart(t *testing.T) {
+	dest, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dest.Close()
+	go func() {
+		for {
+			conn, err := dest.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+	// the client input talks to the server output through the queues of the transport
+	clientOut := &EventQueueImpl{}
+	client := NewTcpInput(&TcpInputConfig{ListenAddr: "127.0.0.1:0", ReadBufferSize: 1024, OpenTimeout: 1000}, clientOut)
+	go client.Run()
+	start := func() context.CancelFunc {
+		serverOut := &EventQueueImpl{}
+		server := NewTcpOutput(&TcpOutputConfig{DestAddr: dest.Addr().String(), ReadBufferSize: 1024}, serverOut)
+		go server.Run()
+		ctx, cancel := context.WithCancel(context.Background())
+		go pump(ctx, clientOut, server)
+		go pump(ctx, serverOut, client)
+		return cancel
+	}
+	stop := start()
+	conn, err := net.Dial("tcp", client.Tunnels[0].Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(time.Second))
+	b := make([]byte, 5)
+	if _, err = conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.ReadFull(conn, b); err != nil || string(b) != "hello" {
+		t.Fatalf("invalid echo %q: %v", b, err)
+	}
+	// the server restarts without the conn, the client learns it from the new epoch
+	stop()
+	stop = start()
+	defer stop()
+	epoch := NewEventEpoch()
+	epoch.OnChange = func() { client.Resume("") }
+	epoch.Observe("a")
+	epoch.Observe("a")
+	_ = conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err = conn.Read(b); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("conn is closed within the same epoch: %v", err)
+	}
+	epoch.Observe("b")
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = conn.Read(b); err != io.EOF {
+		t.Fatalf("orphaned conn is not closed: %v", err)
+	}
+}
@@ -0,0 +1,45 @@
+package euphoria
+
+import (
+	"errors"
+	"path/filepath"
+)
+
+// EventLog makes the events of a queue durable, it is called with the queue lock held.
+// Popped events stay in the log until they are committed, so the events a stage took but did
+// not finish are queued again when the log is opened after a restart.
+type EventLog interface {
+	// Append logs event pushed to the back of the queue.
+	Append(event *Event)
+	// Prepend logs events put back to the front of the queue.
+	Prepend(events []*Event)
+	// Remove marks events popped from the queue.
+	Remove(events []*Event)
+	// Commit drops removed events from the log, every removed event if events is nil.
+	Commit(events []*Event)
+	// Close closes the log, the events left are kept for the next open.
+	Close() error
+	// Delete closes the log and deletes it.
+	Delete() error
+}
+
+type EventLogConfig struct {
+	Type          string `yaml:"Type"`          // "memory" or "disk"
+	Dir           string `yaml:"Dir"`           // directory of the disk logs
+	Fsync         string `yaml:"Fsync"`         // "always", "interval" or "never"
+	FsyncInterval int    `yaml:"FsyncInterval"` // ms between syncs of the "interval" policy
+	SegmentSize   int64  `yaml:"SegmentSize"`   // bytes logged before the log is compacted
+}
+
+// OpenEventLog opens the log of the queue name as configured and returns the events left in it.
+// It returns a nil log for memory queues.
+func OpenEventLog(config *EventLogConfig, name string) (EventLog, []*Event, error) {
+	switch config.Type {
+	case "", "memory":
+		return nil, nil, nil
+	case "disk":
+		return OpenSegmentLog(config, filepath.Join(config.Dir, name))
+	default:
+		return nil, nil, errors.New("invalid queue log type: " + config.Type)
+	}
+}
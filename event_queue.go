@@ -1,7 +1,13 @@
 package euphoria
 
-import "sync"
+import (
+	"context"
+	"sync"
+)
 
+// EventQueue is a queue of events guarded by its lock, every method but Wait and WaitSpace
+// must be called with the lock held. Full and WaitSpace take the session and the id of the
+// conn about to push.
 type EventQueue interface {
 	Push(event *Event)
 	Pop()
@@ -9,21 +15,127 @@ type EventQueue interface {
 	Count() int
 	Empty() bool
 	Recovery(events []*Event)
+	Drain() []*Event
+	Notify()
+	Wait(ctx context.Context) bool
+	Full(session string, from string) bool
+	WaitSpace(ctx context.Context, session string, from string) bool
 	Lock()
 	Unlock()
 }
 
+// EventQueueLimit bounds the events queued, in total and for each conn they are from.
+// A zero field is no limit.
+type EventQueueLimit struct {
+	MaxCount     int `yaml:"MaxCount"`
+	MaxBytes     int `yaml:"MaxBytes"`
+	MaxConnCount int `yaml:"MaxConnCount"`
+	MaxConnBytes int `yaml:"MaxConnBytes"`
+}
+
+// Reached tells if the usage of a queue and of a conn in it reaches the limit.
+func (m EventQueueLimit) Reached(usage EventQueueUsage, conn EventQueueUsage) bool {
+	return (m.MaxCount > 0 && usage.Count >= m.MaxCount) ||
+		(m.MaxBytes > 0 && usage.Bytes >= m.MaxBytes) ||
+		(m.MaxConnCount > 0 && conn.Count >= m.MaxConnCount) ||
+		(m.MaxConnBytes > 0 && conn.Bytes >= m.MaxConnBytes)
+}
+
+// EventQueueUsage is the count and the data bytes of queued events.
+type EventQueueUsage struct {
+	Count int
+	Bytes int
+}
+
+// Plus sums two usages.
+func (m EventQueueUsage) Plus(other EventQueueUsage) EventQueueUsage {
+	return EventQueueUsage{Count: m.Count + other.Count, Bytes: m.Bytes + other.Bytes}
+}
+
+func (m *EventQueueUsage) add(event *Event, n int) {
+	m.Count += n
+	m.Bytes += n * len(event.Dt)
+}
+
+// EventQueueImpl is an EventQueue, pushes never block but producers are expected to wait for
+// space with WaitSpace before pushing the data they read. With a Log the queue is durable, the
+// events popped are committed on the next pop unless ManualCommit is set.
 type EventQueueImpl struct {
 	sync.Mutex
-	Queue []*Event
+	Queue        []*Event
+	Limit        EventQueueLimit
+	Log          EventLog
+	ManualCommit bool
+	usage        EventQueueUsage
+	conns        map[string]*EventQueueUsage
+	signal       chan struct{}
+	space        chan struct{}
+}
+
+// OpenLog opens the log of the queue name as configured, the events left in it are queued again.
+func (m *EventQueueImpl) OpenLog(config *EventLogConfig, name string) error {
+	log, events, err := OpenEventLog(config, name)
+	if err != nil || log == nil {
+		return err
+	}
+	m.Log = log
+	m.Queue = append(m.Queue, events...)
+	for _, event := range events {
+		m.account(event, 1)
+	}
+	m.Notify()
+	return nil
+}
+
+// Commit drops the events popped from the log, every event popped so far if events is nil.
+func (m *EventQueueImpl) Commit(events []*Event) {
+	if m.Log != nil {
+		m.Log.Commit(events)
+	}
+}
+
+// remove commits the events popped before unless ManualCommit is set and logs events popped.
+func (m *EventQueueImpl) remove(events []*Event) {
+	if m.Log == nil {
+		return
+	}
+	if !m.ManualCommit {
+		m.Log.Commit(nil)
+	}
+	m.Log.Remove(events)
+}
+
+// account adds n times event to the usage of the queue and of its conn.
+func (m *EventQueueImpl) account(event *Event, n int) {
+	m.usage.add(event, n)
+	if m.conns == nil {
+		m.conns = make(map[string]*EventQueueUsage)
+	}
+	conn, exist := m.conns[event.Fm]
+	if !exist {
+		conn = &EventQueueUsage{}
+		m.conns[event.Fm] = conn
+	}
+	conn.add(event, n)
+	if conn.Count == 0 {
+		delete(m.conns, event.Fm)
+	}
 }
 
 func (m *EventQueueImpl) Push(event *Event) {
+	if m.Log != nil {
+		m.Log.Append(event)
+	}
 	m.Queue = append(m.Queue, event)
+	m.account(event, 1)
+	m.Notify()
 }
 
 func (m *EventQueueImpl) Pop() {
+	m.remove(m.Queue[:1])
+	m.account(m.Queue[0], -1)
 	m.Queue = m.Queue[1:]
+	m.NotifySpace()
 }
 
 func (m *EventQueueImpl) Front() *Event {
@@ -39,5 +151,111 @@ func (m *EventQueueImpl) Empty() bool {
 }
 
 func (m *EventQueueImpl) Recovery(events []*Event) {
+	if m.Log != nil && len(events) > 0 {
+		m.Log.Prepend(events)
+	}
 	m.Queue = append(events, m.Queue...)
+	for _, event := range events {
+		m.account(event, 1)
+	}
+	m.Notify()
+}
+
+// Drain pops every queued event.
+func (m *EventQueueImpl) Drain() []*Event {
+	events := m.Queue
+	m.remove(events)
+	m.Queue = nil
+	m.usage = EventQueueUsage{}
+	m.conns = nil
+	m.NotifySpace()
+	return events
+}
+
+// Usage is the usage of the whole queue.
+func (m *EventQueueImpl) Usage() EventQueueUsage {
+	return m.usage
+}
+
+// ConnUsage is the usage of the events from the conn from.
+func (m *EventQueueImpl) ConnUsage(from string) EventQueueUsage {
+	if conn, exist := m.conns[from]; exist {
+		return *conn
+	}
+	return EventQueueUsage{}
+}
+
+// Full tells if the queue or the events from the conn from reach the limit, the queue is
+// bounded as a whole whatever the session.
+func (m *EventQueueImpl) Full(session string, from string) bool {
+	return m.Limit.Reached(m.Usage(), m.ConnUsage(from))
+}
+
+// NotifySpace wakes up the waits for space.
+func (m *EventQueueImpl) NotifySpace() {
+	if m.space != nil {
+		close(m.space)
+		m.space = nil
+	}
+}
+
+// SpaceSignal returns a channel closed on the next pop.
+func (m *EventQueueImpl) SpaceSignal() <-chan struct{} {
+	if m.space == nil {
+		m.space = make(chan struct{})
+	}
+	return m.space
+}
+
+// WaitSpace blocks until the queue is not Full for the conn from, it must be called without
+// the lock held. It returns false if ctx is done first.
+func (m *EventQueueImpl) WaitSpace(ctx context.Context, session string, from string) bool {
+	for {
+		m.Lock()
+		if !m.Full(session, from) {
+			m.Unlock()
+			return true
+		}
+		space := m.SpaceSignal()
+		m.Unlock()
+		select {
+		case <-space:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// Notify wakes up the waits on the queue.
+func (m *EventQueueImpl) Notify() {
+	if m.signal != nil {
+		close(m.signal)
+		m.signal = nil
+	}
+}
+
+// Signal returns a channel closed on the next push or notify.
+func (m *EventQueueImpl) Signal() <-chan struct{} {
+	if m.signal == nil {
+		m.signal = make(chan struct{})
+	}
+	return m.signal
+}
+
+// Wait blocks until the queue is not empty or it is notified, it must be called without the
+// lock held. It returns false if ctx is done first.
+func (m *EventQueueImpl) Wait(ctx context.Context) bool {
+	m.Lock()
+	if !m.Empty() {
+		m.Unlock()
+		return true
+	}
+	signal := m.Signal()
+	m.Unlock()
+	select {
+	case <-signal:
+		return true
+	case <-ctx.Done():
+		return false
+	}
 }
@@ -0,0 +1,65 @@
+package euphoria
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestEventQueueWait(t *testing.T) {
+	queue := &EventQueueImpl{}
+	// wait is woken up by a push
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		queue.Lock()
+		queue.Push(&Event{Nm: "a"})
+		queue.Push(&Event{Nm: "b"})
+		queue.Unlock()
+	}()
+	if !queue.Wait(context.Background()) {
+		t.Fatal("wait is not woken up by push")
+	}
+	queue.Lock()
+	events := queue.Drain()
+	empty := queue.Empty()
+	queue.Unlock()
+	if len(events) != 2 || events[0].Nm != "a" || events[1].Nm != "b" || !empty {
+		t.Fatalf("invalid drain: %v", events)
+	}
+	// wait gives up once ctx is done
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if queue.Wait(ctx) {
+		t.Fatal("wait returns events of an empty queue")
+	}
+}
+
+func TestEventQueueLimit(t *testing.T) {
+	queue := &EventQueueImpl{Limit: EventQueueLimit{MaxBytes: 10, MaxConnCount: 2}}
+	queue.Push(&Event{Fm: "a", Dt: make([]byte, 4)})
+	queue.Push(&Event{Fm: "a", Dt: make([]byte, 4)})
+	if !queue.Full("", "a") || queue.Full("", "b") {
+		t.Fatal("conn limit is not applied")
+	}
+	queue.Push(&Event{Fm: "b", Dt: make([]byte, 4)})
+	if !queue.Full("", "b") {
+		t.Fatal("queue limit is not applied")
+	}
+	// a pop wakes up the wait for space
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		queue.Lock()
+		queue.Pop()
+		queue.Unlock()
+	}()
+	if !queue.WaitSpace(context.Background(), "", "a") {
+		t.Fatal("wait for space is not woken up by pop")
+	}
+	queue.Lock()
+	queue.Drain()
+	usage := queue.Usage()
+	queue.Unlock()
+	if usage != (EventQueueUsage{}) || queue.Full("", "a") {
+		t.Fatalf("usage is not cleared by drain: %v", usage)
+	}
+}
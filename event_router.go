@@ -0,0 +1,79 @@
+package euphoria
+
+import (
+	"context"
+	"strings"
+)
+
+// EventRoute sends the events matching Match to Next.
+type EventRoute struct {
+	Match func(event *Event) bool
+	Next  EventQueue
+}
+
+// EventRouter is an EventQueue that pushes every event to the first route matching it instead
+// of queueing it, events matching no route are dropped.
+type EventRouter struct {
+	EventQueueImpl
+	Routes []EventRoute
+}
+
+func NewEventRouter(routes ...EventRoute) *EventRouter {
+	return &EventRouter{
+		EventQueueImpl: EventQueueImpl{},
+		Routes:         routes,
+	}
+}
+
+func (m *EventRouter) Push(event *Event) {
+	for _, route := range m.Routes {
+		if route.Match(event) {
+			route.Next.Lock()
+			route.Next.Push(event)
+			route.Next.Unlock()
+			return
+		}
+	}
+}
+
+// Full tells if the queue of any route is full.
+func (m *EventRouter) Full(session string, from string) bool {
+	for _, route := range m.Routes {
+		route.Next.Lock()
+		full := route.Next.Full(session, from)
+		route.Next.Unlock()
+		if full {
+			return true
+		}
+	}
+	return false
+}
+
+// WaitSpace waits until the queue of every route has space.
+func (m *EventRouter) WaitSpace(ctx context.Context, session string, from string) bool {
+	for _, route := range m.Routes {
+		if !route.Next.WaitSpace(ctx, session, from) {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *EventRouter) Recovery(events []*Event) {
+	for _, event := range events {
+		m.Push(event)
+	}
+}
+
+// NewTunnelEventRouter routes the udp events to the udp stages and the others to the tcp stages.
+// Events sent on behalf of dialed conns or flows go to the input and the others to the output,
+// so a side can both accept conns for its peer and dial conns for it.
+func NewTunnelEventRouter(tcpInput EventQueue, tcpOutput EventQueue, udpInput EventQueue, udpOutput EventQueue) *EventRouter {
+	isUdp := func(event *Event) bool { return strings.HasPrefix(event.Nm, "Udp") }
+	return NewEventRouter(
+		EventRoute{Match: func(event *Event) bool { return isUdp(event) && event.Rp }, Next: udpInput},
+		EventRoute{Match: isUdp, Next: udpOutput},
+		EventRoute{Match: func(event *Event) bool { return event.Rp }, Next: tcpInput},
+		EventRoute{Match: func(event *Event) bool { return true }, Next: tcpOutput},
+	)
+}
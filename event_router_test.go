@@ -0,0 +1,69 @@
+package euphoria
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestEventRouterReverseTunnel(t *testing.T) {
+	dest, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dest.Close()
+	go func() {
+		for {
+			conn, err := dest.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+	// each side accepts conns for its peer and dials the conns of its peer
+	side := func(input *TcpInputConfig, output *TcpOutputConfig) (*TcpInput, *EventRouter, *EventQueueImpl) {
+		out := &EventQueueImpl{}
+		input.ReadBufferSize, input.OpenTimeout = 1024, 1000
+		output.ReadBufferSize = 1024
+		tcpInput := NewTcpInput(input, out)
+		tcpOutput := NewTcpOutput(output, out)
+		go tcpInput.Run()
+		go tcpOutput.Run()
+		return tcpInput, NewTunnelEventRouter(tcpInput, tcpOutput, &EventQueueImpl{}, &EventQueueImpl{}), out
+	}
+	client, clientRouter, clientOut := side(
+		&TcpInputConfig{ListenAddr: "127.0.0.1:0"},
+		&TcpOutputConfig{Destinations: map[string]string{"echo": dest.Addr().String()}},
+	)
+	server, serverRouter, serverOut := side(
+		&TcpInputConfig{Tunnels: []TcpTunnelConfig{{Name: "echo", ListenAddr: "127.0.0.1:0", Session: "laptop"}}},
+		&TcpOutputConfig{DestAddr: dest.Addr().String()},
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go pump(ctx, clientOut, serverRouter)
+	go pump(ctx, serverOut, clientRouter)
+	echo := func(tunnel *TcpTunnel, data string) {
+		conn, err := net.Dial("tcp", tunnel.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		_ = conn.SetDeadline(time.Now().Add(time.Second))
+		if _, err = conn.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, len(data))
+		if _, err = io.ReadFull(conn, b); err != nil || string(b) != data {
+			t.Fatalf("invalid echo %q: %v", b, err)
+		}
+	}
+	// the reverse tunnel is dialed by the client, the replies of the client are routed back
+	// to the server input while the conns of the client input still reach the server output
+	echo(server.Tunnels[0], "reverse")
+	echo(client.Tunnels[0], "forward")
+	echo(server.Tunnels[0], "reverse")
+}
@@ -0,0 +1,93 @@
+package euphoria
+
+// IsControlEvent tells if event carries no stream data, control events are scheduled first.
+func IsControlEvent(event *Event) bool {
+	return event.Nm != "TcpData" && event.Nm != "UdpData"
+}
+
+// EventScheduler builds batches fairly across conns. Control events go first, then the data
+// events of each conn are taken in deficit round robin, Quantum bytes per conn and round.
+type EventScheduler struct {
+	Quantum  int
+	Encoding string
+}
+
+func NewEventScheduler(quantum int, encoding string) *EventScheduler {
+	if quantum <= 0 {
+		quantum = 16384
+	}
+	return &EventScheduler{Quantum: quantum, Encoding: encoding}
+}
+
+// eventFlow is the data events of a conn waiting to be scheduled.
+type eventFlow struct {
+	Events  []*Event
+	Deficit int
+}
+
+// Schedule picks a batch from events and returns the events left in their original order.
+// Events are picked until maxCount events or maxBytes encoded bytes, a zero limit is no limit,
+// and at least one event is picked so a large event is never stuck.
+func (m *EventScheduler) Schedule(events []*Event, maxCount int, maxBytes int) (batch []*Event, rest []*Event) {
+	picked := make(map[*Event]bool)
+	count, bytes := 0, 0
+	pick := func(event *Event) bool {
+		size := EncodedSize(m.Encoding, event)
+		if count > 0 && ((maxCount > 0 && count+1 > maxCount) || (maxBytes > 0 && bytes+size > maxBytes)) {
+			return false
+		}
+		batch = append(batch, event)
+		picked[event] = true
+		count++
+		bytes += size
+		return true
+	}
+	// control events first, data events grouped by conn in order of arrival
+	full := false
+	var keys []string
+	flows := make(map[string]*eventFlow)
+	for _, event := range events {
+		if IsControlEvent(event) {
+			full = full || !pick(event)
+			continue
+		}
+		key := event.Ss + "/" + event.Fm
+		flow, exist := flows[key]
+		if !exist {
+			flow = &eventFlow{}
+			flows[key] = flow
+			keys = append(keys, key)
+		}
+		flow.Events = append(flow.Events, event)
+	}
+	// deficit round robin over the conns
+	for !full && len(keys) > 0 {
+		active := keys[:0]
+		for _, key := range keys {
+			flow := flows[key]
+			flow.Deficit += m.Quantum
+			for !full && len(flow.Events) > 0 && len(flow.Events[0].Dt) <= flow.Deficit {
+				event := flow.Events[0]
+				if !pick(event) {
+					full = true
+					break
+				}
+				flow.Events = flow.Events[1:]
+				flow.Deficit -= len(event.Dt)
+			}
+			if len(flow.Events) > 0 {
+				active = append(active, key)
+			}
+		}
+		keys = active
+	}
+	if len(batch) == len(events) {
+		return batch, nil
+	}
+	for _, event := range events {
+		if !picked[event] {
+			rest = append(rest, event)
+		}
+	}
+	return batch, rest
+}
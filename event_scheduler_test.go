@@ -0,0 +1,38 @@
+package euphoria
+
+import (
+	"testing"
+)
+
+func TestEventScheduler(t *testing.T) {
+	var events []*Event
+	// a bulk conn queued ahead of an interactive one and a control event
+	for i := 0; i < 4; i++ {
+		events = append(events, &Event{Nm: "TcpData", Fm: "bulk", Dt: make([]byte, 100)})
+	}
+	events = append(events, &Event{Nm: "TcpData", Fm: "ssh", Dt: make([]byte, 10)})
+	events = append(events, &Event{Nm: "TcpClose", Fm: "other"})
+	scheduler := NewEventScheduler(100, "application/msgpack")
+	batch, rest := scheduler.Schedule(events, 4, 0)
+	if len(batch) != 4 || batch[0].Nm != "TcpClose" || batch[1].Fm != "bulk" || batch[2].Fm != "ssh" || batch[3].Fm != "bulk" {
+		t.Fatalf("unfair batch: %v", batch)
+	}
+	if len(rest) != 2 || rest[0].Fm != "bulk" || rest[1].Fm != "bulk" {
+		t.Fatalf("invalid rest: %v", rest)
+	}
+	// the encoded size of a batch stays within the byte limit
+	limit := 3 * EncodedSize("application/json", events[0])
+	batch, _ = NewEventScheduler(100, "application/json").Schedule(events, 0, limit)
+	if len(batch) != 3 {
+		t.Fatalf("batch of %v events", len(batch))
+	}
+	b, _ := Encode("application/json", batch)
+	if len(b) > limit {
+		t.Fatalf("encoded batch of %v bytes over %v", len(b), limit)
+	}
+	// without limits every event is scheduled
+	batch, rest = scheduler.Schedule(events, 0, 0)
+	if len(batch) != len(events) || rest != nil {
+		t.Fatalf("batch %v, rest %v", len(batch), len(rest))
+	}
+}
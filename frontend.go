@@ -0,0 +1,50 @@
+package euphoria
+
+import (
+	"errors"
+	"net"
+)
+
+var (
+	ErrAddrNotAllowed = errors.New("destination is not allowed")
+	ErrAuthFailed     = errors.New("proxy authentication failed")
+)
+
+// FrontendRequest is what a front-end negotiated with a local conn.
+type FrontendRequest struct {
+	Destination string // host:port to open
+	Data        []byte // data to send once the destination is opened
+	Method      string // CONNECT, or the method of a plain http request
+}
+
+// TcpFrontend negotiates the destination with a local conn before it is tunnelled.
+type TcpFrontend interface {
+	// Handshake reads the request of conn.
+	Handshake(conn net.Conn) (*FrontendRequest, error)
+	// Reply tells conn whether the destination of request was opened, err is nil on success.
+	Reply(conn net.Conn, request *FrontendRequest, err error) error
+}
+
+// NewTcpFrontend makes the front-end of the tunnel mode, it returns nil for plain tunnels.
+func NewTcpFrontend(config *TcpTunnelConfig) (TcpFrontend, error) {
+	switch config.Mode {
+	case "":
+		return nil, nil
+	case "socks5":
+		return &Socks5Frontend{Config: config}, nil
+	case "http":
+		return &HttpFrontend{Config: config}, nil
+	default:
+		return nil, errors.New("invalid tunnel mode: " + config.Mode)
+	}
+}
+
+// checkCredential tells if user and password match one of the "user:password" credentials.
+func checkCredential(credentials []string, user string, password string) bool {
+	for _, credential := range credentials {
+		if credential == user+":"+password {
+			return true
+		}
+	}
+	return false
+}
@@ -1,86 +1,400 @@
 package euphoria
 
 import (
+	"context"
+	"encoding/hex"
 	"github.com/sirupsen/logrus"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
+const (
+	EventCursorHeader = "X-Event-Cursor"
+	EventAckHeader    = "X-Event-Ack"
+	EventWaitHeader   = "X-Event-Wait"
+	EventEpochHeader  = "X-Event-Epoch"
+)
+
+// DefaultAckTimeout is the ms a polled batch waits for its ack before it is re-delivered.
+const DefaultAckTimeout = 5000
+
+// sessionLogPrefix names the queue logs of the sessions, followed by the hex encoded session id.
+const sessionLogPrefix = "session-"
+
 type HttpEventProviderConfig struct {
-	EventEncode       string `yaml:"EventEncode"`
-	HttpListenAddr    string `yaml:"HttpListenAddr"`
-	BasePath          string `yaml:"BasePath"`
-	EventGetPath      string `yaml:"EventGetPath"`
-	EventCountPath    string `yaml:"EventCountPath"`
-	EventClearPath    string `yaml:"EventClearPath"`
-	MaxEventFetchSize int    `yaml:"MaxEventFetchSize"`
+	EventEncode        string          `yaml:"EventEncode"`
+	HttpListenAddr     string          `yaml:"HttpListenAddr"`
+	BasePath           string          `yaml:"BasePath"`
+	EventGetPath       string          `yaml:"EventGetPath"`
+	EventCountPath     string          `yaml:"EventCountPath"`
+	EventClearPath     string          `yaml:"EventClearPath"`
+	MaxEventFetchSize  int             `yaml:"MaxEventFetchSize"`
+	MaxEventFetchBytes int             `yaml:"MaxEventFetchBytes"`
+	AckTimeout         int             `yaml:"AckTimeout"`
+	SessionTimeout     int             `yaml:"SessionTimeout"`
+	GracePeriod        int             `yaml:"GracePeriod"`
+	ResumeAfter        int             `yaml:"ResumeAfter"`
+	MaxLongPollWait    int             `yaml:"MaxLongPollWait"`
+	AuthTokens         []string        `yaml:"AuthTokens"`
+	QueueLimit         EventQueueLimit `yaml:"QueueLimit"`
+	QueueLog           EventLogConfig  `yaml:"QueueLog"`
+	SchedulerQuantum   int             `yaml:"SchedulerQuantum"`
+}
+
+// EventBatch is a batch of events handed out by the provider, it stays in flight
+// until the client acknowledges its cursor.
+type EventBatch struct {
+	Cursor uint64
+	Sent   time.Time
+	Events []*Event
 }
 
+// HttpEventProvider collects events in its own queue and routes them to the queue of
+// their session when a client fetches.
 type HttpEventProvider struct {
 	EventQueueImpl
-	Config     *HttpEventProviderConfig
-	Logger     *logrus.Entry
-	HttpServer *http.ServeMux
+	Config          *HttpEventProviderConfig
+	Logger          *logrus.Entry
+	HttpServer      *http.ServeMux
+	Cursor          uint64
+	Epoch           string // random id of the process, the conns of a previous epoch are lost
+	Sessions        map[string]*HttpEventSession
+	Expired         map[string]time.Time // last seen of the expired sessions in their grace period
+	OnSessionClose  func(session string)
+	OnSessionResume func(session string)
+	Cipher          *EventCipher
+	Scheduler       *EventScheduler
 }
 
-func NewHttpEventProvider(config *HttpEventProviderConfig, httpServer *http.ServeMux) (provider *HttpEventProvider) {
+func NewHttpEventProvider(config *HttpEventProviderConfig, httpServer *http.ServeMux, cipher *EventCipher) (provider *HttpEventProvider) {
 	provider = &HttpEventProvider{
-		EventQueueImpl: EventQueueImpl{},
+		EventQueueImpl: EventQueueImpl{Limit: config.QueueLimit},
 		Config:         config,
 		Logger:         logrus.WithField("Fm", "HttpEventProvider"),
 		HttpServer:     httpServer,
+		// cursors keep growing across restarts, so a client never takes a new batch for an old one
+		Cursor:          uint64(time.Now().UnixNano()),
+		Epoch:           NewConnectId(),
+		Sessions:        make(map[string]*HttpEventSession),
+		Expired:         make(map[string]time.Time),
+		OnSessionClose:  nil,
+		OnSessionResume: nil,
+		Cipher:          cipher,
+		Scheduler:       NewEventScheduler(config.SchedulerQuantum, config.EventEncode),
 	}
+	if err := provider.OpenLog(&config.QueueLog, "inbox"); err != nil {
+		logrus.WithField("Fm", "NewHttpEventProvider").WithError(err).Fatalln("failed to open queue log!")
+	}
+	provider.RestoreSessions()
 	provider.SetupHandler()
 	return provider
 }
 
 func (m *HttpEventProvider) SetupHandler() {
-	m.HttpServer.HandleFunc(m.Config.BasePath+m.Config.EventGetPath, m.HttpEventGetHandler())
-	m.HttpServer.HandleFunc(m.Config.BasePath+m.Config.EventCountPath, m.HttpEventCountHandler())
-	// TODO add clear
+	m.HttpServer.HandleFunc(m.Config.BasePath+m.Config.EventGetPath, Authenticate(m.Config.AuthTokens, m.HttpEventGetHandler()))
+	m.HttpServer.HandleFunc(m.Config.BasePath+m.Config.EventCountPath, Authenticate(m.Config.AuthTokens, m.HttpEventCountHandler()))
+	// clear is optional, clients without it keep the session until it expires
+	if m.Config.EventClearPath != "" {
+		m.HttpServer.HandleFunc(m.Config.BasePath+m.Config.EventClearPath, Authenticate(m.Config.AuthTokens, m.HttpEventClearHandler()))
+	}
 }
 
 func (m *HttpEventProvider) HttpEventGetHandler() http.HandlerFunc {
 	return func(writer http.ResponseWriter, request *http.Request) {
 		// get events
-		events := make([]*Event, 0, m.Config.MaxEventFetchSize)
+		id := request.Header.Get(EventSessionHeader)
+		ack, _ := strconv.ParseUint(request.Header.Get(EventAckHeader), 10, 64)
 		m.Lock()
-		for !m.Empty() /*&& len(events) < m.Config.MaxEventFetchSize*/ {
-			events = append(events, m.Front())
-			m.Pop()
-		}
+		session := m.Session(id)
+		m.Touch(session)
+		session.Acknowledge(ack)
 		m.Unlock()
-		// TODO comment
-		//for _, event := range events {
-		//	if event.Nm == "TcpData" {
-		//		fmt.Println("===pv===")
-		//		fmt.Println(string(event.Dt[:]))
-		//	}
-		//}
+		wait, _ := strconv.Atoi(request.Header.Get(EventWaitHeader))
+		if wait > m.Config.MaxLongPollWait {
+			wait = m.Config.MaxLongPollWait
+		}
+		// a client of another epoch learns at once that its conns were lost
+		if request.Header.Get(EventEpochHeader) != m.Epoch {
+			wait = 0
+		}
+		batch := m.WaitBatch(request.Context(), id, time.Millisecond*time.Duration(wait), false)
+		events := make([]*Event, 0)
+		writer.Header().Set(EventEpochHeader, m.Epoch)
+		if batch != nil {
+			events = batch.Events
+			writer.Header().Set(EventCursorHeader, strconv.FormatUint(batch.Cursor, 10))
+		}
 		// encode events
-		bytes, err := Encode(m.Config.EventEncode, events)
+		bytes, err := m.Cipher.Encode(m.Config.EventEncode, id, events)
 		if err != nil {
 			m.Logger.WithError(err).Errorln("invalid event encoding")
 			return
 		}
-		// write events
+		// write events, the batch stays in flight until it is acknowledged
 		_, err = writer.Write(bytes[:])
 		if err != nil {
-			m.Logger.WithError(err).Errorln("failed to write data, do recovery!")
-			m.Lock()
-			m.Recovery(events[:])
-			m.Unlock()
+			m.Logger.WithError(err).Errorln("failed to write data, batch will be re-delivered!")
 			return
 		}
 	}
 }
 
+// WaitBatch gets the next batch of session id, it waits up to wait until there is a batch
+// to deliver, or returns nil once the wait expires or ctx is done. A reliable transport
+// does not lose what it delivered, so its batches are re-delivered only once rewound.
+func (m *HttpEventProvider) WaitBatch(ctx context.Context, id string, wait time.Duration, reliable bool) *EventBatch {
+	deadline := time.Now().Add(wait)
+	for {
+		m.Lock()
+		session := m.Session(id)
+		batch := m.NextBatch(session, reliable)
+		signal := m.Signal()
+		wake := time.Until(deadline)
+		if len(session.InFlight) > 0 && !reliable {
+			due := time.Until(session.InFlight[0].Sent.Add(m.AckTimeout()))
+			if due < wake {
+				wake = due
+			}
+		}
+		m.Unlock()
+		if batch != nil || !time.Now().Before(deadline) {
+			return batch
+		}
+		timer := time.NewTimer(wake)
+		select {
+		case <-signal:
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		}
+		timer.Stop()
+	}
+}
+
+// Session routes the queued events to their sessions and returns the session of id,
+// it is created if it does not exist yet.
+func (m *HttpEventProvider) Session(id string) *HttpEventSession {
+	m.route()
+	return m.session(id)
+}
+
+// route moves the queued events to the queues of their sessions.
+func (m *HttpEventProvider) route() {
+	for !m.Empty() {
+		// logged in the session before it is dropped from the inbox, so a restart never loses it
+		event := m.Front()
+		m.session(event.Ss).Push(event)
+		m.Pop()
+	}
+	m.Commit(nil)
+}
+
+func (m *HttpEventProvider) session(id string) *HttpEventSession {
+	session, exist := m.Sessions[id]
+	if !exist {
+		session = NewHttpEventSession(id)
+		// a session coming back in its grace period keeps its last seen so it is resumed
+		if seen, expired := m.Expired[id]; expired {
+			session.LastSeen = seen
+			delete(m.Expired, id)
+		}
+		if err := session.OpenLog(&m.Config.QueueLog, sessionLogPrefix+hex.EncodeToString([]byte(id))); err != nil {
+			m.Logger.WithError(err).Errorf("failed to open queue log of session %v!", id)
+		}
+		m.Sessions[id] = session
+		m.Logger.WithField("Alive", len(m.Sessions)).Infof("session %v created!", id)
+	}
+	return session
+}
+
+// Touch marks session seen. A session seen again after ResumeAfter, as after it expired, is
+// reported to OnSessionResume so its conns retransmit what was lost meanwhile.
+func (m *HttpEventProvider) Touch(session *HttpEventSession) {
+	idle := time.Since(session.LastSeen)
+	session.LastSeen = time.Now()
+	if m.Config.ResumeAfter > 0 && idle > time.Millisecond*time.Duration(m.Config.ResumeAfter) {
+		m.Logger.Infof("session %v resumed after %v!", session.Id, idle.Round(time.Millisecond))
+		m.Resume(session.Id)
+	}
+}
+
+// Resume reports session id to OnSessionResume, it is called in the background as the conns
+// push events to the provider.
+func (m *HttpEventProvider) Resume(id string) {
+	if m.OnSessionResume != nil {
+		go m.OnSessionResume(id)
+	}
+}
+
+// RestoreSessions opens the sessions whose queue logs were left by a previous process.
+func (m *HttpEventProvider) RestoreSessions() {
+	if m.Config.QueueLog.Type != "disk" {
+		return
+	}
+	entries, err := os.ReadDir(m.Config.QueueLog.Dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		encoded, found := strings.CutPrefix(entry.Name(), sessionLogPrefix)
+		id, err := hex.DecodeString(encoded)
+		if found && err == nil {
+			m.session(string(id))
+		}
+	}
+}
+
+// NextBatch returns the oldest in-flight batch of session once it is rewound or, unless reliable,
+// once its ack timeout expired, otherwise a new batch taken from the session queue. It returns
+// nil if there is nothing to deliver yet.
+func (m *HttpEventProvider) NextBatch(session *HttpEventSession, reliable bool) *EventBatch {
+	now := time.Now()
+	if len(session.InFlight) > 0 {
+		batch := session.InFlight[0]
+		if !batch.Sent.IsZero() && (reliable || now.Sub(batch.Sent) < m.AckTimeout()) {
+			return nil
+		}
+		m.Logger.Debugf("re-deliver batch %v", batch.Cursor)
+		batch.Sent = now
+		return batch
+	}
+	if session.Empty() {
+		return nil
+	}
+	// take a fair batch, the events left wait for the next batch
+	events, rest := m.Scheduler.Schedule(session.Drain(), m.Config.MaxEventFetchSize, MaxBatchBytes(m.Config.MaxEventFetchBytes))
+	session.Recovery(rest)
+	m.Cursor++
+	batch := &EventBatch{
+		Cursor: m.Cursor,
+		Sent:   now,
+		Events: events,
+	}
+	session.InFlight = append(session.InFlight, batch)
+	m.NotifySpace()
+	return batch
+}
+
+// AckTimeout is the time a batch waits for its ack before it is re-delivered to polling clients.
+func (m *HttpEventProvider) AckTimeout() time.Duration {
+	if m.Config.AckTimeout <= 0 {
+		return time.Millisecond * DefaultAckTimeout
+	}
+	return time.Millisecond * time.Duration(m.Config.AckTimeout)
+}
+
+// Full tells if the events of session waiting for a batch reach QueueLimit, so a client that
+// stops fetching only blocks the conns of its own session.
+func (m *HttpEventProvider) Full(session string, from string) bool {
+	m.route()
+	s, exist := m.Sessions[session]
+	if !exist {
+		return false
+	}
+	return m.Limit.Reached(s.Usage(), s.ConnUsage(from))
+}
+
+// WaitSpace blocks until the provider is not Full for the conn from of session.
+func (m *HttpEventProvider) WaitSpace(ctx context.Context, session string, from string) bool {
+	for {
+		m.Lock()
+		if !m.Full(session, from) {
+			m.Unlock()
+			return true
+		}
+		space := m.SpaceSignal()
+		m.Unlock()
+		select {
+		case <-space:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// Expire drops the sessions not seen for SessionTimeout with their events, their conns are kept
+// for GracePeriod more in case the client resumes before they are reported to OnSessionClose.
+func (m *HttpEventProvider) Expire() {
+	if m.Config.SessionTimeout <= 0 {
+		return
+	}
+	timeout := time.Millisecond * time.Duration(m.Config.SessionTimeout)
+	var closed []string
+	m.Lock()
+	for id, session := range m.Sessions {
+		if time.Since(session.LastSeen) > timeout {
+			session.DeleteLog()
+			delete(m.Sessions, id)
+			m.Expired[id] = session.LastSeen
+			m.Logger.WithField("Alive", len(m.Sessions)).Infof("session %v expired!", id)
+		}
+	}
+	for id, seen := range m.Expired {
+		if time.Since(seen) > timeout+time.Millisecond*time.Duration(m.Config.GracePeriod) {
+			delete(m.Expired, id)
+			closed = append(closed, id)
+			m.Logger.Infof("session %v closed!", id)
+		}
+	}
+	m.NotifySpace()
+	m.Unlock()
+	if m.OnSessionClose != nil {
+		for _, id := range closed {
+			m.OnSessionClose(id)
+		}
+	}
+}
+
+func (m *HttpEventProvider) Run() {
+	if m.Config.SessionTimeout <= 0 {
+		return
+	}
+	interval := m.Config.SessionTimeout
+	if m.Config.GracePeriod > 0 && m.Config.GracePeriod < interval {
+		interval = m.Config.GracePeriod
+	}
+	for {
+		time.Sleep(time.Millisecond * time.Duration(interval))
+		m.Expire()
+	}
+}
+
 func (m *HttpEventProvider) HttpEventCountHandler() http.HandlerFunc {
 	return func(writer http.ResponseWriter, request *http.Request) {
 		m.Lock()
 		res := make(map[string]interface{})
-		res["count"] = m.Count()
+		res["count"] = m.Session(request.Header.Get(EventSessionHeader)).Count()
 		b, _ := Encode(m.Config.EventEncode, &res)
 		_, _ = writer.Write(b[:])
 		m.Unlock()
 	}
 }
+
+// HttpEventClearHandler drops the events queued and in flight for the session and reports it
+// to OnSessionClose, a client clears its session on startup so nothing of a previous process
+// reaches its new conns.
+func (m *HttpEventProvider) HttpEventClearHandler() http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method != http.MethodPost && request.Method != http.MethodDelete {
+			writer.Header().Set("Allow", "POST, DELETE")
+			writer.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		id := request.Header.Get(EventSessionHeader)
+		m.Lock()
+		// route the events not routed yet before dropping the session
+		m.Session(id).DeleteLog()
+		delete(m.Sessions, id)
+		delete(m.Expired, id)
+		m.NotifySpace()
+		m.Logger.WithField("Alive", len(m.Sessions)).Infof("session %v cleared!", id)
+		m.Unlock()
+		if m.OnSessionClose != nil {
+			m.OnSessionClose(id)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package euphoria
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newTestProvider(config *HttpEventProviderConfig) *HttpEventProvider {
+	config.EventEncode = "application/msgpack"
+	config.EventGetPath = "/get"
+	config.EventCountPath = "/count"
+	config.EventClearPath = "/clear"
+	return NewHttpEventProvider(config, http.NewServeMux(), nil)
+}
+
+func TestHttpEventProviderLimit(t *testing.T) {
+	provider := newTestProvider(&HttpEventProviderConfig{QueueLimit: EventQueueLimit{MaxCount: 2}})
+	provider.Push(&Event{Fm: "a", Ss: "x"})
+	provider.Push(&Event{Fm: "b", Ss: "x"})
+	// a full session does not block the conns of another session
+	if !provider.Full("x", "c") || provider.Full("y", "d") {
+		t.Fatal("limit is not applied per session")
+	}
+	provider.Push(&Event{Fm: "d", Ss: "y"})
+	if provider.Full("y", "d") {
+		t.Fatal("events of other sessions are counted")
+	}
+}
+
+func TestHttpEventProviderGet(t *testing.T) {
+	provider := newTestProvider(&HttpEventProviderConfig{AckTimeout: 20})
+	handler := provider.HttpEventGetHandler()
+	get := func(ack uint64) (uint64, []*Event) {
+		request := httptest.NewRequest(http.MethodGet, "/get", nil)
+		request.Header.Set(EventAckHeader, strconv.FormatUint(ack, 10))
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		var events []*Event
+		if err := Decode(provider.Config.EventEncode, recorder.Body.Bytes(), &events); err != nil {
+			t.Fatal(err)
+		}
+		cursor, _ := strconv.ParseUint(recorder.Header().Get(EventCursorHeader), 10, 64)
+		return cursor, events
+	}
+	provider.Lock()
+	provider.Push(&Event{Nm: "a"})
+	provider.Unlock()
+	first, events := get(0)
+	if first == 0 || len(events) != 1 || events[0].Nm != "a" {
+		t.Fatalf("invalid batch %v: %v", first, events)
+	}
+	// the batch is in flight until it is acknowledged or its ack timeout expires
+	if cursor, events := get(0); cursor != 0 || len(events) != 0 {
+		t.Fatalf("batch %v delivered before the ack timeout: %v", cursor, events)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if cursor, events := get(0); cursor != first || len(events) != 1 || events[0].Nm != "a" {
+		t.Fatalf("batch %v is not re-delivered: %v", cursor, events)
+	}
+	// an ack drops the batch and the next one is delivered
+	provider.Lock()
+	provider.Push(&Event{Nm: "b"})
+	provider.Unlock()
+	second, events := get(first)
+	if second <= first || len(events) != 1 || events[0].Nm != "b" {
+		t.Fatalf("invalid batch %v after ack: %v", second, events)
+	}
+	if cursor, events := get(second); cursor != 0 || len(events) != 0 {
+		t.Fatalf("acknowledged batch %v is re-delivered: %v", cursor, events)
+	}
+}
+
+func TestHttpEventProviderClear(t *testing.T) {
+	provider := newTestProvider(&HttpEventProviderConfig{AckTimeout: 20})
+	do := func(method string, path string, session string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, path, nil)
+		request.Header.Set(EventSessionHeader, session)
+		recorder := httptest.NewRecorder()
+		provider.HttpServer.ServeHTTP(recorder, request)
+		return recorder
+	}
+	get := func(session string) []*Event {
+		var events []*Event
+		if err := Decode(provider.Config.EventEncode, do(http.MethodGet, "/get", session).Body.Bytes(), &events); err != nil {
+			t.Fatal(err)
+		}
+		return events
+	}
+	// the conns of the sessions on the server
+	output := NewTcpOutput(&TcpOutputConfig{}, provider)
+	provider.OnSessionClose = output.CloseSession
+	conns := make(map[string]*Connect)
+	for _, session := range []string{"x", "y"} {
+		conn, _ := net.Pipe()
+		conns[session] = NewConnect(conn, session, "")
+		conns[session].Session = session
+		output.Registry[session] = conns[session]
+	}
+	// x has a batch in flight and an event queued
+	provider.Lock()
+	provider.Push(&Event{Nm: "a", Ss: "x"})
+	provider.Unlock()
+	if events := get("x"); len(events) != 1 {
+		t.Fatalf("invalid batch %v", events)
+	}
+	provider.Lock()
+	provider.Push(&Event{Nm: "b", Ss: "x"})
+	provider.Push(&Event{Nm: "c", Ss: "y"})
+	provider.Unlock()
+	if code := do(http.MethodGet, "/clear", "x").Code; code != http.StatusMethodNotAllowed {
+		t.Fatalf("clear answers get with %v", code)
+	}
+	if code := do(http.MethodPost, "/clear", "x").Code; code != http.StatusOK {
+		t.Fatalf("clear answers post with %v", code)
+	}
+	// nothing of x is delivered or re-delivered, its conns are closed and y is left alone
+	time.Sleep(30 * time.Millisecond)
+	if events := get("x"); len(events) != 0 {
+		t.Fatalf("cleared events delivered: %v", events)
+	}
+	if conns["x"].Context.Err() == nil || conns["y"].Context.Err() != nil {
+		t.Fatal("conns of the wrong session closed")
+	}
+	if events := get("y"); len(events) != 1 || events[0].Nm != "c" {
+		t.Fatalf("events of another session dropped: %v", events)
+	}
+	// a server without clear neither panics nor holds up the client
+	config := &HttpEventProviderConfig{EventEncode: "application/msgpack", EventGetPath: "/get", EventCountPath: "/count"}
+	server := httptest.NewServer(NewHttpEventProvider(config, http.NewServeMux(), nil).HttpServer)
+	defer server.Close()
+	retriever := NewHttpEventRetriever(&HttpEventRetrieverConfig{BaseAddr: server.URL, EventClearPath: "/clear"}, server.Client(), &EventQueueImpl{}, nil)
+	cleared := make(chan struct{})
+	go func() {
+		retriever.Clear()
+		close(cleared)
+	}()
+	select {
+	case <-cleared:
+	case <-time.After(time.Second):
+		t.Fatal("clear is retried on a server without it")
+	}
+}
+
+func TestHttpEventProviderLongPoll(t *testing.T) {
+	provider := newTestProvider(&HttpEventProviderConfig{})
+	// a long poll returns as soon as an event is pushed
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		provider.Lock()
+		provider.Push(&Event{Nm: "a", Ss: "x"})
+		provider.Unlock()
+	}()
+	start := time.Now()
+	batch := provider.WaitBatch(context.Background(), "x", 5*time.Second, false)
+	if batch == nil || len(batch.Events) != 1 || time.Since(start) > time.Second {
+		t.Fatalf("invalid batch %v after %v", batch, time.Since(start))
+	}
+	// and with nothing to deliver once the wait expires
+	if batch = provider.WaitBatch(context.Background(), "y", 20*time.Millisecond, false); batch != nil {
+		t.Fatalf("invalid batch %v", batch)
+	}
+	// a client idles on a server that does not hold long polls instead of spinning
+	server := httptest.NewServer(provider.HttpServer)
+	defer server.Close()
+	retriever := NewHttpEventRetriever(&HttpEventRetrieverConfig{
+		EventEncode:  provider.Config.EventEncode,
+		BaseAddr:     server.URL,
+		EventGetPath: "/get",
+		IdleInterval: 20,
+		LongPollWait: 1000,
+	}, server.Client(), &EventQueueImpl{}, nil)
+	start = time.Now()
+	for i := 0; i < 5; i++ {
+		retriever.Update()
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Fatalf("5 empty gets in %v without idling", elapsed)
+	}
+}
@@ -7,10 +7,11 @@ import (
 )
 
 type HttpEventReceiverConfig struct {
-	EventEncode    string `yaml:"EventEncode"`
-	HttpListenAddr string `yaml:"HttpListenAddr"`
-	BasePath       string `yaml:"BasePath"`
-	EventPostPath  string `yaml:"EventPostPath"`
+	EventEncode    string   `yaml:"EventEncode"`
+	HttpListenAddr string   `yaml:"HttpListenAddr"`
+	BasePath       string   `yaml:"BasePath"`
+	EventPostPath  string   `yaml:"EventPostPath"`
+	AuthTokens     []string `yaml:"AuthTokens"`
 }
 
 type HttpEventReceiver struct {
@@ -18,21 +19,23 @@ type HttpEventReceiver struct {
 	Logger     *logrus.Entry
 	HttpServer *http.ServeMux
 	Next       EventQueue
+	Cipher     *EventCipher
 }
 
-func NewHttpEventReceiver(config *HttpEventReceiverConfig, httpServer *http.ServeMux, next EventQueue) *HttpEventReceiver {
+func NewHttpEventReceiver(config *HttpEventReceiverConfig, httpServer *http.ServeMux, next EventQueue, cipher *EventCipher) *HttpEventReceiver {
 	receiver := &HttpEventReceiver{
 		Config:     config,
 		Logger:     logrus.WithField("Fm", "HttpEventReceiver"),
 		HttpServer: httpServer,
 		Next:       next,
+		Cipher:     cipher,
 	}
 	receiver.SetupHandler()
 	return receiver
 }
 
 func (m *HttpEventReceiver) SetupHandler() {
-	m.HttpServer.HandleFunc(m.Config.BasePath+m.Config.EventPostPath, m.HttpEventPostHandler())
+	m.HttpServer.HandleFunc(m.Config.BasePath+m.Config.EventPostPath, Authenticate(m.Config.AuthTokens, m.HttpEventPostHandler()))
 }
 
 func (m *HttpEventReceiver) HttpEventPostHandler() http.HandlerFunc {
@@ -44,14 +47,22 @@ func (m *HttpEventReceiver) HttpEventPostHandler() http.HandlerFunc {
 			return
 		}
 		// make and send event
+		session := request.Header.Get(EventSessionHeader)
 		var events []*Event
-		err = Decode(m.Config.EventEncode, b, &events)
+		err = m.Cipher.Decode(m.Config.EventEncode, session, b, &events)
 		if err != nil {
-			m.Logger.WithError(err).Errorln("failed to decode events!")
+			m.Logger.WithError(err).Errorln("failed to decode events, rejected!")
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		// hold the client back while the next queue is full, it retries if it gives up
+		if !m.Next.WaitSpace(request.Context(), "", "") {
+			writer.WriteHeader(http.StatusServiceUnavailable)
 			return
 		}
 		m.Next.Lock()
 		for i := 0; i < len(events); i++ {
+			events[i].Ss = session
 			m.Next.Push(events[i])
 		}
 		m.Next.Unlock()
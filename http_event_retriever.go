@@ -1,9 +1,11 @@
 package euphoria
 
 import (
+	"context"
 	"github.com/sirupsen/logrus"
 	"io"
 	"net/http"
+	"strconv"
 	"time"
 )
 
@@ -14,6 +16,9 @@ type HttpEventRetrieverConfig struct {
 	EventGetPath   string `yaml:"EventGetPath"`
 	EventCountPath string `yaml:"EventCountPath"`
 	EventClearPath string `yaml:"EventClearPath"`
+	SessionId      string `yaml:"SessionId"`
+	LongPollWait   int    `yaml:"LongPollWait"`
+	AuthToken      string `yaml:"AuthToken"`
 }
 
 type HttpEventRetriever struct {
@@ -21,14 +26,19 @@ type HttpEventRetriever struct {
 	Logger *logrus.Entry
 	Client *http.Client
 	Next   EventQueue
+	Cursor uint64
+	Cipher *EventCipher
+	Epoch  *EventEpoch // tells the conns when the server restarted, nil if nobody cares
 }
 
-func NewHttpEventRetriever(config *HttpEventRetrieverConfig, client *http.Client, next EventQueue) *HttpEventRetriever {
+func NewHttpEventRetriever(config *HttpEventRetrieverConfig, client *http.Client, next EventQueue, cipher *EventCipher) *HttpEventRetriever {
 	return &HttpEventRetriever{
 		Config: config,
 		Logger: logrus.WithField("Fm", "HttpEventRetriever"),
 		Client: client,
 		Next:   next,
+		Cursor: 0,
+		Cipher: cipher,
 	}
 }
 
@@ -37,14 +47,38 @@ func (m *HttpEventRetriever) Idle() {
 }
 
 func (m *HttpEventRetriever) Update() {
-	// do request
-	res, err := m.Client.Get(m.Config.BaseAddr + m.Config.EventGetPath)
+	// fetch once the next queue has space, the server holds the events meanwhile
+	m.Next.WaitSpace(context.Background(), "", "")
+	// do request, acknowledging the last batch received
+	request, err := http.NewRequest(http.MethodGet, m.Config.BaseAddr+m.Config.EventGetPath, nil)
+	if err != nil {
+		m.Logger.WithError(err).Errorln("failed to make get request!")
+		m.Idle()
+		return
+	}
+	request.Header.Set(EventSessionHeader, m.Config.SessionId)
+	SetAuthToken(request.Header, m.Config.AuthToken)
+	request.Header.Set(EventAckHeader, strconv.FormatUint(m.Cursor, 10))
+	if epoch := m.Epoch.Value(); epoch != "" {
+		request.Header.Set(EventEpochHeader, epoch)
+	}
+	if m.Config.LongPollWait > 0 {
+		request.Header.Set(EventWaitHeader, strconv.Itoa(m.Config.LongPollWait))
+	}
+	start := time.Now()
+	res, err := m.Client.Do(request)
 	if err != nil {
 		m.Logger.WithError(err).Errorln("failed to do get request!")
 		m.Idle()
 		return
 	}
 	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		m.Logger.WithField("Code", res.StatusCode).Errorln("failed to do get request!")
+		m.Idle()
+		return
+	}
+	m.Epoch.Observe(res.Header.Get(EventEpochHeader))
 	// read data
 	b, err := io.ReadAll(res.Body)
 	if err != nil {
@@ -54,12 +88,18 @@ func (m *HttpEventRetriever) Update() {
 	}
 	// decode data to event
 	var events []*Event
-	err = Decode(m.Config.EventEncode, b, &events)
+	err = m.Cipher.Decode(m.Config.EventEncode, m.Config.SessionId, b, &events)
 	if err != nil {
-		m.Logger.WithError(err).Errorln("failed to decode response data!")
+		m.Logger.WithError(err).Errorln("failed to decode response data, rejected!")
 		m.Idle()
 		return
 	}
+	// drop batches that were already processed
+	cursor, _ := strconv.ParseUint(res.Header.Get(EventCursorHeader), 10, 64)
+	if cursor != 0 && cursor <= m.Cursor {
+		m.Logger.Debugf("drop re-delivered batch %v", cursor)
+		return
+	}
 	// process event
 	m.Next.Lock()
 	for _, event := range events {
@@ -71,8 +111,48 @@ func (m *HttpEventRetriever) Update() {
 		//}
 	}
 	m.Next.Unlock()
-	// idle
-	if len(events) == 0 {
+	if cursor != 0 {
+		m.Cursor = cursor
+	}
+	// idle, unless a long poll has already waited on the server, a server answering empty
+	// well before the wait does not hold long polls
+	waited := m.Config.LongPollWait > 0 && time.Since(start) >= time.Millisecond*time.Duration(m.Config.LongPollWait)/2
+	if len(events) == 0 && !waited {
+		m.Idle()
+	}
+}
+
+// Clear drops what the server holds for the session and closes its conns there, it retries
+// until the server confirms. Nothing is cleared without EventClearPath or if the server does
+// not support it.
+func (m *HttpEventRetriever) Clear() {
+	if m.Config.EventClearPath == "" {
+		return
+	}
+	for {
+		request, err := http.NewRequest(http.MethodPost, m.Config.BaseAddr+m.Config.EventClearPath, nil)
+		if err != nil {
+			m.Logger.WithError(err).Errorln("failed to make clear request!")
+			return
+		}
+		request.Header.Set(EventSessionHeader, m.Config.SessionId)
+		SetAuthToken(request.Header, m.Config.AuthToken)
+		res, err := m.Client.Do(request)
+		if err != nil {
+			m.Logger.WithError(err).Errorln("failed to clear session! retry!")
+			m.Idle()
+			continue
+		}
+		res.Body.Close()
+		if res.StatusCode == http.StatusOK {
+			m.Logger.Infof("session %v cleared!", m.Config.SessionId)
+			return
+		}
+		if res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusMethodNotAllowed {
+			m.Logger.WithField("Code", res.StatusCode).Warnln("server does not support clear, session is not cleared!")
+			return
+		}
+		m.Logger.WithField("Code", res.StatusCode).Errorln("failed to clear session! retry!")
 		m.Idle()
 	}
 }
@@ -2,72 +2,95 @@ package euphoria
 
 import (
 	"bytes"
+	"context"
 	"github.com/sirupsen/logrus"
 	"net/http"
 	"time"
 )
 
 type HttpEventSenderConfig struct {
-	EventEncode   string `yaml:"EventEncode"`
-	BaseAddr      string `yaml:"BaseAddr"`
-	IdleInterval  int    `yaml:"IdleInterval"`
-	EventPostPath string `yaml:"EventPostPath"`
+	EventEncode       string          `yaml:"EventEncode"`
+	BaseAddr          string          `yaml:"BaseAddr"`
+	IdleInterval      int             `yaml:"IdleInterval"`
+	EventPostPath     string          `yaml:"EventPostPath"`
+	SessionId         string          `yaml:"SessionId"`
+	AuthToken         string          `yaml:"AuthToken"`
+	QueueLimit        EventQueueLimit `yaml:"QueueLimit"`
+	QueueLog          EventLogConfig  `yaml:"QueueLog"`
+	SchedulerQuantum  int             `yaml:"SchedulerQuantum"`
+	MaxEventPostSize  int             `yaml:"MaxEventPostSize"`
+	MaxEventPostBytes int             `yaml:"MaxEventPostBytes"`
 }
 
 type HttpEventSender struct {
 	EventQueueImpl
-	Config *HttpEventSenderConfig
-	Logger *logrus.Entry
-	Client *http.Client
+	Config    *HttpEventSenderConfig
+	Logger    *logrus.Entry
+	Client    *http.Client
+	Cipher    *EventCipher
+	Scheduler *EventScheduler
 }
 
-func NewHttpEventSender(config *HttpEventSenderConfig, client *http.Client) *HttpEventSender {
-	return &HttpEventSender{
-		EventQueueImpl: EventQueueImpl{},
+func NewHttpEventSender(config *HttpEventSenderConfig, client *http.Client, cipher *EventCipher) *HttpEventSender {
+	sender := &HttpEventSender{
+		EventQueueImpl: EventQueueImpl{Limit: config.QueueLimit},
 		Config:         config,
 		Logger:         logrus.WithField("Fm", "HttpEventSender"),
 		Client:         client,
+		Cipher:         cipher,
+		Scheduler:      NewEventScheduler(config.SchedulerQuantum, config.EventEncode),
 	}
+	if err := sender.OpenLog(&config.QueueLog, "sender"); err != nil {
+		logrus.WithField("Fm", "NewHttpEventSender").WithError(err).Fatalln("failed to open queue log!")
+	}
+	return sender
 }
 func (m *HttpEventSender) Idle() {
 	time.Sleep(time.Millisecond * time.Duration(m.Config.IdleInterval))
 }
 
 func (m *HttpEventSender) Update() {
-	m.Lock()
-	empty := m.Empty()
-	m.Unlock()
-	if empty {
-		m.Idle()
+	// wait for events
+	if !m.Wait(context.Background()) {
 		return
 	}
-	// get event
-	var events []*Event
+	// take a fair batch, the events left wait for the next post
 	m.Lock()
-	for !m.Empty() {
-		events = append(events, m.Front())
-		m.Pop()
-	}
+	events, rest := m.Scheduler.Schedule(m.Drain(), m.Config.MaxEventPostSize, MaxBatchBytes(m.Config.MaxEventPostBytes))
+	m.Recovery(rest)
 	m.Unlock()
-
-	// TODO post data type detect
-	data, err := Encode(m.Config.EventEncode, &events)
-	if err != nil {
-		m.Logger.WithError(err).Error("")
+	if len(events) == 0 {
 		return
 	}
-	// send events
+
+	// send events, a retried post may deliver the events twice, duplicates are dropped by sequence
 	for {
-		res, err := m.Client.Post(m.Config.BaseAddr+m.Config.EventPostPath,
-			m.Config.EventEncode,
-			bytes.NewReader(data[:]),
-		)
+		// sealed data is accepted once, so every try is sealed again
+		data, err := m.Cipher.Encode(m.Config.EventEncode, m.Config.SessionId, &events)
+		if err != nil {
+			m.Logger.WithError(err).Error("")
+			return
+		}
+		request, err := http.NewRequest(http.MethodPost, m.Config.BaseAddr+m.Config.EventPostPath, bytes.NewReader(data[:]))
+		if err != nil {
+			m.Logger.WithError(err).Errorln("failed to make post request!")
+			return
+		}
+		request.Header.Set("Content-Type", m.Config.EventEncode)
+		request.Header.Set(EventSessionHeader, m.Config.SessionId)
+		SetAuthToken(request.Header, m.Config.AuthToken)
+		res, err := m.Client.Do(request)
+		if err != nil {
+			m.Logger.WithError(err).Errorln("failed to post events! retry!")
+			m.Idle()
+			continue
+		}
 		res.Body.Close()
-		if err == nil && res.StatusCode == http.StatusOK {
+		if res.StatusCode == http.StatusOK {
 			break
-		} else {
-			m.Logger.WithError(err).WithField("Code", res.StatusCode).Errorln("failed to post events! retry!")
 		}
+		m.Logger.WithField("Code", res.StatusCode).Errorln("failed to post events! retry!")
+		m.Idle()
 	}
 	//m.Logger.Debugf("send %v events", len(events))
 }
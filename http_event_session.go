@@ -0,0 +1,56 @@
+package euphoria
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+const EventSessionHeader = "X-Event-Session"
+
+// HttpEventSession holds the events pending for one client of the provider, the events in flight
+// are committed to its queue log once they are acknowledged.
+type HttpEventSession struct {
+	EventQueueImpl
+	Id       string
+	InFlight []*EventBatch
+	LastSeen time.Time
+}
+
+func NewHttpEventSession(id string) *HttpEventSession {
+	return &HttpEventSession{
+		EventQueueImpl: EventQueueImpl{ManualCommit: true},
+		Id:             id,
+		InFlight:       nil,
+		LastSeen:       time.Now(),
+	}
+}
+
+// Acknowledge drops every in-flight batch up to and including cursor.
+func (m *HttpEventSession) Acknowledge(cursor uint64) {
+	for len(m.InFlight) > 0 && m.InFlight[0].Cursor <= cursor {
+		m.Commit(m.InFlight[0].Events)
+		m.InFlight = m.InFlight[1:]
+	}
+}
+
+// DeleteLog deletes the queue log of a session dropped by the provider.
+func (m *HttpEventSession) DeleteLog() {
+	if m.Log != nil {
+		_ = m.Log.Delete()
+	}
+}
+
+// Rewind makes every in-flight batch due for re-delivery.
+func (m *HttpEventSession) Rewind() {
+	for _, batch := range m.InFlight {
+		batch.Sent = time.Time{}
+	}
+}
+
+// NewSessionId makes a random session id for a client.
+func NewSessionId() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,123 @@
+package euphoria
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strings"
+)
+
+// HttpFrontend is an http proxy. A CONNECT request opens a tunnel to its authority, any other
+// request is sent to the host of its absolute url with the rest of the conn passed as it is.
+// It requires basic proxy authentication if the tunnel has Credentials.
+type HttpFrontend struct {
+	Config *TcpTunnelConfig
+}
+
+func (m *HttpFrontend) Handshake(conn net.Conn) (*FrontendRequest, error) {
+	reader := bufio.NewReader(conn)
+	tp := textproto.NewReader(reader)
+	// read request line and header
+	line, err := tp.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Split(line, " ")
+	if len(parts) != 3 {
+		_ = m.reply(conn, http.StatusBadRequest)
+		return nil, errors.New("invalid request line: " + line)
+	}
+	method, uri, proto := parts[0], parts[1], parts[2]
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	// authenticate
+	if len(m.Config.Credentials) > 0 {
+		user, password, ok := m.credential(header.Get("Proxy-Authorization"))
+		if !ok || !checkCredential(m.Config.Credentials, user, password) {
+			_, _ = fmt.Fprintf(conn, "HTTP/1.1 407 %v\r\nProxy-Authenticate: Basic realm=\"euphoria\"\r\nConnection: close\r\nContent-Length: 0\r\n\r\n",
+				http.StatusText(http.StatusProxyAuthRequired))
+			return nil, ErrAuthFailed
+		}
+	}
+	// data the client sent after the header
+	buffered, _ := reader.Peek(reader.Buffered())
+	if method == http.MethodConnect {
+		return &FrontendRequest{
+			Destination: m.hostPort(uri, "443"),
+			Data:        buffered,
+			Method:      method,
+		}, nil
+	}
+	// plain request, rewrite it to origin form
+	target, err := url.Parse(uri)
+	if err != nil || target.Scheme != "http" || target.Host == "" {
+		_ = m.reply(conn, http.StatusBadRequest)
+		return nil, errors.New("invalid proxy request uri: " + uri)
+	}
+	delete(header, "Proxy-Authorization")
+	delete(header, "Proxy-Connection")
+	header.Set("Connection", "close")
+	var b bytes.Buffer
+	_, _ = fmt.Fprintf(&b, "%v %v %v\r\n", method, target.RequestURI(), proto)
+	_ = http.Header(header).Write(&b)
+	b.WriteString("\r\n")
+	b.Write(buffered)
+	return &FrontendRequest{
+		Destination: m.hostPort(target.Host, "80"),
+		Data:        b.Bytes(),
+		Method:      method,
+	}, nil
+}
+
+func (m *HttpFrontend) Reply(conn net.Conn, request *FrontendRequest, err error) error {
+	switch err {
+	case nil:
+		// the response of a plain request comes from the destination
+		if request.Method != http.MethodConnect {
+			return nil
+		}
+		_, err = fmt.Fprint(conn, "HTTP/1.1 200 Connection Established\r\n\r\n")
+		return err
+	case ErrAddrNotAllowed:
+		return m.reply(conn, http.StatusForbidden)
+	case ErrOpenTimeout:
+		return m.reply(conn, http.StatusGatewayTimeout)
+	default:
+		return m.reply(conn, http.StatusBadGateway)
+	}
+}
+
+// reply writes an empty response with code.
+func (m *HttpFrontend) reply(conn net.Conn, code int) error {
+	_, err := fmt.Fprintf(conn, "HTTP/1.1 %v %v\r\nConnection: close\r\nContent-Length: 0\r\n\r\n", code, http.StatusText(code))
+	return err
+}
+
+// hostPort adds port to host if it has none.
+func (m *HttpFrontend) hostPort(host string, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
+
+// credential decodes a basic Proxy-Authorization header.
+func (m *HttpFrontend) credential(authorization string) (string, string, bool) {
+	encoded, found := strings.CutPrefix(authorization, "Basic ")
+	if !found {
+		return "", "", false
+	}
+	b, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(b), ":")
+}
@@ -0,0 +1,59 @@
+package euphoria
+
+import (
+	"encoding/base64"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestHttpFrontendHandshake(t *testing.T) {
+	handshake := func(config *TcpTunnelConfig, request string) (*FrontendRequest, string, error) {
+		conn, peer := net.Pipe()
+		response := make(chan string, 1)
+		go func() {
+			_, _ = peer.Write([]byte(request))
+			b, _ := io.ReadAll(peer)
+			response <- string(b)
+		}()
+		frontend := &HttpFrontend{Config: config}
+		result, err := frontend.Handshake(conn)
+		conn.Close()
+		return result, <-response, err
+	}
+	for request, expect := range map[string]string{
+		"CONNECT example.com:8443 HTTP/1.1\r\nHost: example.com:8443\r\n\r\n": "example.com:8443",
+		"CONNECT example.com HTTP/1.1\r\n\r\n":                                "example.com:443",
+		"CONNECT [::1] HTTP/1.1\r\n\r\n":                                      "[::1]:443",
+	} {
+		result, _, err := handshake(&TcpTunnelConfig{}, request)
+		if err != nil || result.Destination != expect || result.Method != "CONNECT" {
+			t.Fatalf("invalid request %+v for %q: %v", result, request, err)
+		}
+	}
+	// the data sent after the header goes along with the request
+	result, _, err := handshake(&TcpTunnelConfig{}, "CONNECT example.com:443 HTTP/1.1\r\n\r\nhello")
+	if err != nil || string(result.Data) != "hello" {
+		t.Fatalf("invalid data %+v: %v", result, err)
+	}
+	// a plain request is rewritten to origin form
+	result, _, err = handshake(&TcpTunnelConfig{}, "GET http://example.com/foo?bar HTTP/1.1\r\nProxy-Connection: keep-alive\r\n\r\n")
+	if err != nil || result.Destination != "example.com:80" || !strings.HasPrefix(string(result.Data), "GET /foo?bar HTTP/1.1\r\n") ||
+		strings.Contains(string(result.Data), "Proxy-Connection") {
+		t.Fatalf("invalid plain request %+v: %v", result, err)
+	}
+	// an invalid request line is refused
+	if _, response, err := handshake(&TcpTunnelConfig{}, "CONNECT example.com:443\r\n\r\n"); err == nil || !strings.HasPrefix(response, "HTTP/1.1 400") {
+		t.Fatalf("invalid request line accepted: %q", response)
+	}
+	// with credentials the request must authenticate
+	config := &TcpTunnelConfig{Credentials: []string{"user:password"}}
+	if _, response, err := handshake(config, "CONNECT example.com:443 HTTP/1.1\r\n\r\n"); err != ErrAuthFailed || !strings.HasPrefix(response, "HTTP/1.1 407") {
+		t.Fatalf("unauthenticated request accepted: %q", response)
+	}
+	authorization := "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte("user:password")) + "\r\n"
+	if _, _, err := handshake(config, "CONNECT example.com:443 HTTP/1.1\r\n"+authorization+"\r\n"); err != nil {
+		t.Fatalf("authenticated request refused: %v", err)
+	}
+}
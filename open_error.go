@@ -0,0 +1,57 @@
+package euphoria
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// Reasons carried by a TcpOpenFailed event.
+const (
+	OpenFailedGeneral     = 0x01
+	OpenFailedNotAllowed  = 0x02
+	OpenFailedUnreachable = 0x03
+	OpenFailedRefused     = 0x04
+	OpenFailedTimeout     = 0x05
+)
+
+var (
+	ErrOpenFailed      = errors.New("failed to open remote")
+	ErrHostUnreachable = errors.New("remote is unreachable")
+	ErrConnRefused     = errors.New("remote refused the conn")
+)
+
+// OpenFailedReason classifies the error of a dial.
+func OpenFailedReason(err error) byte {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return OpenFailedRefused
+	case errors.As(err, &dnsErr), errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return OpenFailedUnreachable
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return OpenFailedTimeout
+	default:
+		return OpenFailedGeneral
+	}
+}
+
+// OpenFailedError is the error a front-end replies for the reason of a TcpOpenFailed event.
+func OpenFailedError(reason []byte) error {
+	if len(reason) != 1 {
+		return ErrOpenFailed
+	}
+	switch reason[0] {
+	case OpenFailedNotAllowed:
+		return ErrAddrNotAllowed
+	case OpenFailedUnreachable:
+		return ErrHostUnreachable
+	case OpenFailedRefused:
+		return ErrConnRefused
+	case OpenFailedTimeout:
+		return ErrOpenTimeout
+	default:
+		return ErrOpenFailed
+	}
+}
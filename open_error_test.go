@@ -0,0 +1,26 @@
+package euphoria
+
+import (
+	"net"
+	"testing"
+)
+
+func TestOpenFailedReason(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	_ = listener.Close()
+	// nothing listens on addr any more
+	_, err = net.Dial("tcp", addr)
+	if reason := OpenFailedReason(err); reason != OpenFailedRefused {
+		t.Fatalf("invalid reason %v of %v", reason, err)
+	}
+	if err = OpenFailedError([]byte{OpenFailedRefused}); err != ErrConnRefused {
+		t.Fatalf("invalid error %v", err)
+	}
+	if err = OpenFailedError(nil); err != ErrOpenFailed {
+		t.Fatalf("invalid error %v", err)
+	}
+}
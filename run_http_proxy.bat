@@ -1,2 +0,0 @@
-@echo off
-go run github.com/saisesai/euphoria/bin --mode http-proxy --config=foo
@@ -0,0 +1,374 @@
+package euphoria
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultSegmentSize   = 64 << 20
+	DefaultFsyncInterval = 1000
+)
+
+const (
+	segmentAppend = 'A'
+	segmentRemove = 'D'
+	segmentSuffix = ".seg"
+)
+
+// SegmentLog is an EventLog kept in append-only segment files of a directory. A record either
+// adds an event with its key, the keys give the order of the events in the queue, or drops the
+// event of a key. Once SegmentSize bytes are logged, a new segment starts with the events still
+// in the log and the older segments are deleted.
+type SegmentLog struct {
+	Config  *EventLogConfig
+	Dir     string
+	Logger  *logrus.Entry
+	mutex   sync.Mutex
+	file    *os.File
+	segment int
+	logged  int64
+	front   int64
+	back    int64
+	keys    map[*Event]int64
+	removed map[*Event]bool
+	dirty   bool
+	failed  bool
+	done    chan struct{}
+}
+
+// OpenSegmentLog opens the log in dir, it is compacted to a new segment holding the events
+// left, which are returned in queue order.
+func OpenSegmentLog(config *EventLogConfig, dir string) (*SegmentLog, []*Event, error) {
+	switch config.Fsync {
+	case "", "always", "interval", "never":
+	default:
+		return nil, nil, errors.New("invalid fsync policy: " + config.Fsync)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, nil, err
+	}
+	m := &SegmentLog{
+		Config:  config,
+		Dir:     dir,
+		Logger:  logrus.WithField("Fm", "SegmentLog").WithField("Dir", dir),
+		keys:    make(map[*Event]int64),
+		removed: make(map[*Event]bool),
+		done:    make(chan struct{}),
+	}
+	// replay the segments
+	segments, err := m.segments()
+	if err != nil {
+		return nil, nil, err
+	}
+	events := make(map[int64]*Event)
+	for _, segment := range segments {
+		if err = m.replay(segment, events); err != nil {
+			m.Logger.WithError(err).Warnf("failed to replay segment %v, the rest of it is dropped!", segment)
+		}
+		m.segment = segment
+	}
+	for key, event := range events {
+		m.keys[event] = key
+		if key < m.front {
+			m.front = key
+		}
+		if key > m.back {
+			m.back = key
+		}
+	}
+	if err = m.compact(); err != nil {
+		return nil, nil, err
+	}
+	if len(events) > 0 {
+		m.Logger.Infof("%v events recovered!", len(events))
+	}
+	if config.Fsync == "" || config.Fsync == "interval" {
+		go m.syncLoop()
+	}
+	return m, m.events(), nil
+}
+
+func (m *SegmentLog) Append(event *Event) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.back++
+	m.keys[event] = m.back
+	m.write(m.record(segmentAppend, m.back, event))
+}
+
+func (m *SegmentLog) Prepend(events []*Event) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	// events popped and put back keep their keys
+	restore := true
+	for _, event := range events {
+		restore = restore && m.removed[event]
+	}
+	if restore {
+		for _, event := range events {
+			delete(m.removed, event)
+		}
+		return
+	}
+	var b []byte
+	for _, event := range events {
+		if key, exist := m.keys[event]; exist {
+			b = append(b, m.record(segmentRemove, key, nil)...)
+			delete(m.removed, event)
+		}
+	}
+	for i := len(events) - 1; i >= 0; i-- {
+		m.front--
+		m.keys[events[i]] = m.front
+	}
+	for _, event := range events {
+		b = append(b, m.record(segmentAppend, m.keys[event], event)...)
+	}
+	m.write(b)
+}
+
+func (m *SegmentLog) Remove(events []*Event) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, event := range events {
+		if _, exist := m.keys[event]; exist {
+			m.removed[event] = true
+		}
+	}
+}
+
+func (m *SegmentLog) Commit(events []*Event) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if events == nil {
+		for event := range m.removed {
+			events = append(events, event)
+		}
+	}
+	var b []byte
+	for _, event := range events {
+		if !m.removed[event] {
+			continue
+		}
+		b = append(b, m.record(segmentRemove, m.keys[event], nil)...)
+		delete(m.keys, event)
+		delete(m.removed, event)
+	}
+	if len(b) > 0 {
+		m.write(b)
+	}
+}
+
+func (m *SegmentLog) Close() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.file == nil {
+		return nil
+	}
+	close(m.done)
+	err := m.file.Sync()
+	if closeErr := m.file.Close(); err == nil {
+		err = closeErr
+	}
+	m.file = nil
+	return err
+}
+
+func (m *SegmentLog) Delete() error {
+	_ = m.Close()
+	return os.RemoveAll(m.Dir)
+}
+
+// record encodes a record as its length, its crc, its type, the key and the event if any.
+func (m *SegmentLog) record(kind byte, key int64, event *Event) []byte {
+	body := []byte{kind}
+	body = binary.BigEndian.AppendUint64(body, uint64(key))
+	if event != nil {
+		b, err := Encode("application/msgpack", event)
+		if err != nil {
+			m.Logger.WithError(err).Errorln("failed to encode event!")
+		}
+		body = append(body, b...)
+	}
+	record := binary.BigEndian.AppendUint32(nil, uint32(len(body)))
+	record = binary.BigEndian.AppendUint32(record, crc32.ChecksumIEEE(body))
+	return append(record, body...)
+}
+
+// write appends b to the current segment and compacts the log once the segment is full.
+func (m *SegmentLog) write(b []byte) {
+	if m.file == nil {
+		return
+	}
+	if _, err := m.file.Write(b); err != nil {
+		if !m.failed {
+			m.Logger.WithError(err).Errorln("failed to write segment, events are kept in memory only!")
+		}
+		m.failed = true
+		return
+	}
+	m.failed = false
+	m.dirty = true
+	if m.Config.Fsync == "always" {
+		m.sync()
+	}
+	m.logged += int64(len(b))
+	size := m.Config.SegmentSize
+	if size <= 0 {
+		size = DefaultSegmentSize
+	}
+	if m.logged >= size {
+		if err := m.compact(); err != nil {
+			m.Logger.WithError(err).Errorln("failed to compact segments!")
+		}
+	}
+}
+
+func (m *SegmentLog) sync() {
+	if err := m.file.Sync(); err != nil {
+		m.Logger.WithError(err).Errorln("failed to sync segment!")
+	}
+	m.dirty = false
+}
+
+func (m *SegmentLog) syncLoop() {
+	interval := m.Config.FsyncInterval
+	if interval <= 0 {
+		interval = DefaultFsyncInterval
+	}
+	ticker := time.NewTicker(time.Millisecond * time.Duration(interval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.mutex.Lock()
+			if m.file != nil && m.dirty {
+				m.sync()
+			}
+			m.mutex.Unlock()
+		case <-m.done:
+			return
+		}
+	}
+}
+
+// compact starts a new segment with the events in the log and deletes the older segments.
+func (m *SegmentLog) compact() error {
+	var b []byte
+	for _, event := range m.events() {
+		b = append(b, m.record(segmentAppend, m.keys[event], event)...)
+	}
+	segment := m.segment + 1
+	file, err := os.OpenFile(m.path(segment), os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(b); err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		_ = file.Close()
+		_ = os.Remove(m.path(segment))
+		return err
+	}
+	if m.file != nil {
+		_ = m.file.Close()
+	}
+	m.file = file
+	m.segment = segment
+	m.logged = 0
+	m.dirty = false
+	segments, err := m.segments()
+	if err != nil {
+		return err
+	}
+	for _, old := range segments {
+		if old < segment {
+			_ = os.Remove(m.path(old))
+		}
+	}
+	return nil
+}
+
+// replay applies the records of segment to events.
+func (m *SegmentLog) replay(segment int, events map[int64]*Event) error {
+	b, err := os.ReadFile(m.path(segment))
+	if err != nil {
+		return err
+	}
+	for len(b) > 0 {
+		if len(b) < 8 {
+			return errors.New("truncated record")
+		}
+		size := int(binary.BigEndian.Uint32(b))
+		if len(b) < 8+size || size < 9 {
+			return errors.New("truncated record")
+		}
+		body := b[8 : 8+size]
+		if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(b[4:]) {
+			return errors.New("corrupted record")
+		}
+		b = b[8+size:]
+		key := int64(binary.BigEndian.Uint64(body[1:]))
+		switch body[0] {
+		case segmentAppend:
+			event := &Event{}
+			if err = Decode("application/msgpack", body[9:], event); err != nil {
+				return err
+			}
+			events[key] = event
+		case segmentRemove:
+			delete(events, key)
+		default:
+			return errors.New("invalid record type: " + strconv.Itoa(int(body[0])))
+		}
+	}
+	return nil
+}
+
+// events returns the events in the log ordered by key.
+func (m *SegmentLog) events() []*Event {
+	events := make([]*Event, 0, len(m.keys))
+	for event := range m.keys {
+		events = append(events, event)
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return m.keys[events[i]] < m.keys[events[j]]
+	})
+	return events
+}
+
+// segments lists the numbers of the segments in the directory in order.
+func (m *SegmentLog) segments() ([]int, error) {
+	entries, err := os.ReadDir(m.Dir)
+	if err != nil {
+		return nil, err
+	}
+	var segments []int
+	for _, entry := range entries {
+		name, found := strings.CutSuffix(entry.Name(), segmentSuffix)
+		if !found {
+			continue
+		}
+		if segment, err := strconv.Atoi(name); err == nil {
+			segments = append(segments, segment)
+		}
+	}
+	sort.Ints(segments)
+	return segments, nil
+}
+
+func (m *SegmentLog) path(segment int) string {
+	return filepath.Join(m.Dir, fmt.Sprintf("%020d%v", segment, segmentSuffix))
+}
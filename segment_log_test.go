@@ -0,0 +1,54 @@
+package euphoria
+
+import (
+	"testing"
+)
+
+func TestSegmentLog(t *testing.T) {
+	config := &EventLogConfig{Type: "disk", Dir: t.TempDir(), Fsync: "always", SegmentSize: 256}
+	names := func(queue *EventQueueImpl) (s string) {
+		for _, event := range queue.Queue {
+			s += event.Nm
+		}
+		return s
+	}
+	queue := &EventQueueImpl{}
+	if err := queue.OpenLog(config, "queue"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		queue.Push(&Event{Nm: name, Dt: make([]byte, 32)})
+	}
+	// a is taken, the others are put back, then b is taken and z is put back and taken
+	events := queue.Drain()
+	queue.Recovery(events[1:])
+	queue.Pop()
+	queue.Recovery([]*Event{{Nm: "z"}})
+	queue.Pop()
+	queue.Push(&Event{Nm: "f"})
+	if names(queue) != "cdef" {
+		t.Fatalf("invalid queue: %v", names(queue))
+	}
+	_ = queue.Log.Close()
+	// z is not committed by a later pop so it is queued again, the segments were compacted on the way
+	queue = &EventQueueImpl{}
+	if err := queue.OpenLog(config, "queue"); err != nil {
+		t.Fatal(err)
+	}
+	if names(queue) != "zcdef" || queue.Usage().Count != 5 {
+		t.Fatalf("invalid recovered queue: %v", names(queue))
+	}
+	segments, _ := queue.Log.(*SegmentLog).segments()
+	if len(segments) != 1 {
+		t.Fatalf("segments are not compacted: %v", segments)
+	}
+	// a deleted log is empty
+	_ = queue.Log.Delete()
+	queue = &EventQueueImpl{}
+	if err := queue.OpenLog(config, "queue"); err != nil {
+		t.Fatal(err)
+	}
+	if !queue.Empty() {
+		t.Fatalf("deleted log is not empty: %v", names(queue))
+	}
+}
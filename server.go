@@ -11,10 +11,17 @@ type ServerConfig struct {
 		EventEncode    string `yaml:"EventEncode"`
 		HttpListenAddr string `yaml:"HttpListenAddr"`
 		BasePath       string `yaml:"BasePath"`
+		CipherKey      string `yaml:"CipherKey"`
 	} `yaml:"Common"`
-	HttpEventProvider HttpEventProviderConfig `yaml:"HttpEventProvider"`
-	HttpEventReceiver HttpEventReceiverConfig `yaml:"HttpEventReceiver"`
-	TcpOutput         TcpOutputConfig         `yaml:"TcpOutput"`
+	Tls                 TlsServerConfig           `yaml:"Tls"`
+	HttpEventProvider   HttpEventProviderConfig   `yaml:"HttpEventProvider"`
+	HttpEventReceiver   HttpEventReceiverConfig   `yaml:"HttpEventReceiver"`
+	TcpOutput           TcpOutputConfig           `yaml:"TcpOutput"`
+	TcpInput            TcpInputConfig            `yaml:"TcpInput"`
+	UdpOutput           UdpOutputConfig           `yaml:"UdpOutput"`
+	UdpInput            UdpInputConfig            `yaml:"UdpInput"`
+	WsEventEndpoint     WsEventEndpointConfig     `yaml:"WsEventEndpoint"`
+	StreamEventEndpoint StreamEventEndpointConfig `yaml:"StreamEventEndpoint"`
 }
 
 func (m *ServerConfig) String() string {
@@ -23,12 +30,18 @@ func (m *ServerConfig) String() string {
 }
 
 type Server struct {
-	Config            *ServerConfig
-	Logger            *logrus.Entry
-	HttpServer        *http.ServeMux
-	HttpEventProvider *HttpEventProvider
-	HttpEventReceiver *HttpEventReceiver
-	TcpOutput         *TcpOutput
+	Config              *ServerConfig
+	Logger              *logrus.Entry
+	HttpServer          *http.ServeMux
+	HttpEventProvider   *HttpEventProvider
+	HttpEventReceiver   *HttpEventReceiver
+	TcpOutput           *TcpOutput
+	TcpInput            *TcpInput
+	UdpOutput           *UdpOutput
+	UdpInput            *UdpInput
+	EventRouter         *EventRouter
+	WsEventEndpoint     *WsEventEndpoint
+	StreamEventEndpoint *StreamEventEndpoint
 }
 
 func NewServer(config *ServerConfig) (server *Server) {
@@ -37,14 +50,54 @@ func NewServer(config *ServerConfig) (server *Server) {
 		Logger:     logrus.WithField("Fm", "HttpServer"),
 		HttpServer: http.NewServeMux(),
 	}
-	server.HttpEventProvider = NewHttpEventProvider(&config.HttpEventProvider, server.HttpServer)
+	// every endpoint shares the cipher, so data opened by one is a replay to the others
+	cipher, err := NewEventCipher(config.Common.CipherKey, CipherServer)
+	if err != nil {
+		server.Logger.WithError(err).Fatalln("invalid cipher key!")
+	}
+	server.HttpEventProvider = NewHttpEventProvider(&config.HttpEventProvider, server.HttpServer, cipher)
 	server.TcpOutput = NewTcpOutput(&config.TcpOutput, server.HttpEventProvider)
-	server.HttpEventReceiver = NewHttpEventReceiver(&config.HttpEventReceiver, server.HttpServer, server.TcpOutput)
+	// the input accepts the conns of tunnels dialed by the client
+	server.TcpInput = NewTcpInput(&config.TcpInput, server.HttpEventProvider)
+	server.UdpOutput = NewUdpOutput(&config.UdpOutput, server.HttpEventProvider)
+	server.UdpInput = NewUdpInput(&config.UdpInput, server.HttpEventProvider)
+	server.EventRouter = NewTunnelEventRouter(server.TcpInput, server.TcpOutput, server.UdpInput, server.UdpOutput)
+	server.HttpEventProvider.OnSessionClose = func(session string) {
+		server.TcpOutput.CloseSession(session)
+		server.TcpInput.CloseSession(session)
+		server.UdpOutput.CloseSession(session)
+		server.UdpInput.CloseSession(session)
+	}
+	server.HttpEventProvider.OnSessionResume = func(session string) {
+		server.TcpOutput.Resume(session)
+		server.TcpInput.Resume(session)
+	}
+	server.HttpEventReceiver = NewHttpEventReceiver(&config.HttpEventReceiver, server.HttpServer, server.EventRouter, cipher)
+	server.WsEventEndpoint = NewWsEventEndpoint(&config.WsEventEndpoint, server.HttpServer, server.HttpEventProvider, server.EventRouter, cipher)
+	server.StreamEventEndpoint = NewStreamEventEndpoint(&config.StreamEventEndpoint, server.HttpServer, server.HttpEventProvider, server.EventRouter, cipher)
 	return server
 }
 
 func (m *Server) Run() {
 	go m.TcpOutput.Run()
-	m.Logger.Info("listen at:", m.Config.Common.HttpListenAddr)
-	_ = http.ListenAndServe(m.Config.Common.HttpListenAddr, m.HttpServer)
+	go m.TcpInput.Run()
+	go m.UdpOutput.Run()
+	go m.UdpInput.Run()
+	go m.HttpEventProvider.Run()
+	tlsConfig, err := NewServerTlsConfig(&m.Config.Tls)
+	if err != nil {
+		m.Logger.WithError(err).Fatalln("failed to setup tls!")
+	}
+	if tlsConfig == nil {
+		m.Logger.Info("listen at:", m.Config.Common.HttpListenAddr)
+		_ = http.ListenAndServe(m.Config.Common.HttpListenAddr, m.HttpServer)
+		return
+	}
+	httpServer := &http.Server{
+		Addr:      m.Config.Common.HttpListenAddr,
+		Handler:   m.HttpServer,
+		TLSConfig: tlsConfig,
+	}
+	m.Logger.Info("listen with tls at:", m.Config.Common.HttpListenAddr)
+	_ = httpServer.ListenAndServeTLS("", "")
 }
@@ -0,0 +1,169 @@
+package euphoria
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+)
+
+const (
+	Socks5Version          = 0x05
+	Socks5NoAuth           = 0x00
+	Socks5UserPassAuth     = 0x02
+	Socks5NoAcceptable     = 0xff
+	Socks5UserPassVersion  = 0x01
+	Socks5Connect          = 0x01
+	Socks5AddrIpv4         = 0x01
+	Socks5AddrDomain       = 0x03
+	Socks5AddrIpv6         = 0x04
+	Socks5Succeeded        = 0x00
+	Socks5GeneralFailure   = 0x01
+	Socks5NotAllowed       = 0x02
+	Socks5HostUnreachable  = 0x04
+	Socks5ConnRefused      = 0x05
+	Socks5TtlExpired       = 0x06
+	Socks5CommandNotFound  = 0x07
+	Socks5AddrNotSupported = 0x08
+)
+
+// Socks5Frontend is a socks5 server supporting the connect command, it requires username and
+// password authentication if the tunnel has Credentials.
+type Socks5Frontend struct {
+	Config *TcpTunnelConfig
+}
+
+func (m *Socks5Frontend) Handshake(conn net.Conn) (*FrontendRequest, error) {
+	// greeting
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return nil, err
+	}
+	if head[0] != Socks5Version {
+		return nil, errors.New("invalid socks version: " + strconv.Itoa(int(head[0])))
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return nil, err
+	}
+	expect := byte(Socks5NoAuth)
+	if len(m.Config.Credentials) > 0 {
+		expect = Socks5UserPassAuth
+	}
+	method := byte(Socks5NoAcceptable)
+	for _, m := range methods {
+		if m == expect {
+			method = expect
+		}
+	}
+	if _, err := conn.Write([]byte{Socks5Version, method}); err != nil {
+		return nil, err
+	}
+	if method == Socks5NoAcceptable {
+		return nil, errors.New("no acceptable socks auth method")
+	}
+	if method == Socks5UserPassAuth {
+		if err := m.authenticate(conn); err != nil {
+			return nil, err
+		}
+	}
+	// request
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return nil, err
+	}
+	if request[1] != Socks5Connect {
+		_ = m.reply(conn, Socks5CommandNotFound)
+		return nil, errors.New("unsupported socks command: " + strconv.Itoa(int(request[1])))
+	}
+	var host string
+	switch request[3] {
+	case Socks5AddrIpv4, Socks5AddrIpv6:
+		size := net.IPv4len
+		if request[3] == Socks5AddrIpv6 {
+			size = net.IPv6len
+		}
+		ip := make([]byte, size)
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return nil, err
+		}
+		host = net.IP(ip).String()
+	case Socks5AddrDomain:
+		domain, err := m.readString(conn)
+		if err != nil {
+			return nil, err
+		}
+		host = domain
+	default:
+		_ = m.reply(conn, Socks5AddrNotSupported)
+		return nil, errors.New("unsupported socks address type: " + strconv.Itoa(int(request[3])))
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return nil, err
+	}
+	return &FrontendRequest{
+		Destination: net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))),
+		Data:        nil,
+		Method:      "CONNECT",
+	}, nil
+}
+
+// authenticate does the username and password sub-negotiation of rfc 1929.
+func (m *Socks5Frontend) authenticate(conn net.Conn) error {
+	version := make([]byte, 1)
+	if _, err := io.ReadFull(conn, version); err != nil {
+		return err
+	}
+	user, err := m.readString(conn)
+	if err != nil {
+		return err
+	}
+	password, err := m.readString(conn)
+	if err != nil {
+		return err
+	}
+	if version[0] != Socks5UserPassVersion || !checkCredential(m.Config.Credentials, user, password) {
+		_, _ = conn.Write([]byte{Socks5UserPassVersion, Socks5GeneralFailure})
+		return ErrAuthFailed
+	}
+	_, err = conn.Write([]byte{Socks5UserPassVersion, Socks5Succeeded})
+	return err
+}
+
+// readString reads a string prefixed with its length in one byte.
+func (m *Socks5Frontend) readString(conn net.Conn) (string, error) {
+	size := make([]byte, 1)
+	if _, err := io.ReadFull(conn, size); err != nil {
+		return "", err
+	}
+	b := make([]byte, size[0])
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func (m *Socks5Frontend) Reply(conn net.Conn, _ *FrontendRequest, err error) error {
+	switch err {
+	case nil:
+		return m.reply(conn, Socks5Succeeded)
+	case ErrAddrNotAllowed:
+		return m.reply(conn, Socks5NotAllowed)
+	case ErrHostUnreachable:
+		return m.reply(conn, Socks5HostUnreachable)
+	case ErrConnRefused:
+		return m.reply(conn, Socks5ConnRefused)
+	case ErrOpenTimeout:
+		return m.reply(conn, Socks5TtlExpired)
+	default:
+		return m.reply(conn, Socks5GeneralFailure)
+	}
+}
+
+// reply writes a reply with code, the bound address is left empty as the conn is tunnelled.
+func (m *Socks5Frontend) reply(conn net.Conn, code byte) error {
+	_, err := conn.Write([]byte{Socks5Version, code, 0x00, Socks5AddrIpv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
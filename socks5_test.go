@@ -0,0 +1,143 @@
+package euphoria
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSocks5Handshake(t *testing.T) {
+	handshake := func(config *TcpTunnelConfig, request []byte) (*FrontendRequest, []byte, error) {
+		conn, peer := net.Pipe()
+		response := make(chan []byte, 1)
+		// the replies are written while the request is still being read
+		go peer.Write(request)
+		go func() {
+			b, _ := io.ReadAll(peer)
+			response <- b
+		}()
+		result, err := (&Socks5Frontend{Config: config}).Handshake(conn)
+		conn.Close()
+		return result, <-response, err
+	}
+	greeting := []byte{Socks5Version, 2, 0x02, Socks5NoAuth}
+	accepted := []byte{Socks5Version, Socks5NoAuth}
+	for expect, request := range map[string][]byte{
+		"example.com:443": {Socks5Version, Socks5Connect, 0, Socks5AddrDomain, 11, 'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'c', 'o', 'm', 0x01, 0xbb},
+		"10.0.0.1:22":     {Socks5Version, Socks5Connect, 0, Socks5AddrIpv4, 10, 0, 0, 1, 0, 22},
+		"[::1]:8080":      {Socks5Version, Socks5Connect, 0, Socks5AddrIpv6, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x1f, 0x90},
+	} {
+		result, response, err := handshake(&TcpTunnelConfig{}, append(greeting, request...))
+		if err != nil || result.Destination != expect || !bytes.Equal(response, accepted) {
+			t.Fatalf("invalid request %+v with response %v for %v: %v", result, response, expect, err)
+		}
+	}
+	// an auth method other than none is rejected
+	if _, response, err := handshake(&TcpTunnelConfig{}, []byte{Socks5Version, 1, 0x02}); err == nil || !bytes.Equal(response, []byte{Socks5Version, Socks5NoAcceptable}) {
+		t.Fatalf("auth method accepted with response %v", response)
+	}
+	// so are commands other than connect and unknown address types
+	if _, response, err := handshake(&TcpTunnelConfig{}, append(greeting, Socks5Version, 0x02, 0, Socks5AddrIpv4)); err == nil || response[3] != Socks5CommandNotFound {
+		t.Fatalf("bind command accepted with response %v", response)
+	}
+	if _, response, err := handshake(&TcpTunnelConfig{}, append(greeting, Socks5Version, Socks5Connect, 0, 0x05)); err == nil || response[3] != Socks5AddrNotSupported {
+		t.Fatalf("address type accepted with response %v", response)
+	}
+	// with credentials the conn must authenticate with them
+	config := &TcpTunnelConfig{Credentials: []string{"user:password"}}
+	if _, response, err := handshake(config, []byte{Socks5Version, 1, Socks5NoAuth}); err == nil || !bytes.Equal(response, []byte{Socks5Version, Socks5NoAcceptable}) {
+		t.Fatalf("unauthenticated conn accepted with response %v", response)
+	}
+	auth := func(user string, password string) []byte {
+		b := append([]byte{Socks5Version, 1, Socks5UserPassAuth, Socks5UserPassVersion, byte(len(user))}, user...)
+		return append(append(b, byte(len(password))), password...)
+	}
+	if _, response, err := handshake(config, auth("user", "foo")); err != ErrAuthFailed || response[3] != Socks5GeneralFailure {
+		t.Fatalf("invalid credentials accepted with response %v", response)
+	}
+	request := []byte{Socks5Version, Socks5Connect, 0, Socks5AddrIpv4, 10, 0, 0, 1, 0, 22}
+	if result, response, err := handshake(config, append(auth("user", "password"), request...)); err != nil || result.Destination != "10.0.0.1:22" || response[3] != Socks5Succeeded {
+		t.Fatalf("valid credentials refused with response %v: %v", response, err)
+	}
+}
+
+func TestSocks5AllowList(t *testing.T) {
+	dest, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dest.Close()
+	go func() {
+		for {
+			conn, err := dest.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+	inputOut := &EventQueueImpl{}
+	outputOut := &EventQueueImpl{}
+	input := NewTcpInput(&TcpInputConfig{
+		Tunnels: []TcpTunnelConfig{
+			{Name: "socks5", ListenAddr: "127.0.0.1:0", Mode: "socks5"},
+			{Name: "local", ListenAddr: "127.0.0.1:0", Mode: "socks5", AllowList: []string{"127.0.0.1:*"}},
+		},
+		ReadBufferSize: 1024,
+		OpenTimeout:    100,
+	}, inputOut)
+	output := NewTcpOutput(&TcpOutputConfig{
+		AllowList:      []string{"127.0.0.1:*"},
+		ReadBufferSize: 1024,
+	}, outputOut)
+	go input.Run()
+	go output.Run()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go pump(ctx, inputOut, output)
+	go pump(ctx, outputOut, input)
+	port := dest.Addr().(*net.TCPAddr).Port
+	connect := func(tunnel *TcpTunnel, host string) byte {
+		conn, err := net.Dial("tcp", tunnel.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		_ = conn.SetDeadline(time.Now().Add(time.Second))
+		request := []byte{Socks5Version, 1, Socks5NoAuth, Socks5Version, Socks5Connect, 0, Socks5AddrDomain, byte(len(host))}
+		request = binary.BigEndian.AppendUint16(append(request, host...), uint16(port))
+		if _, err = conn.Write(request); err != nil {
+			t.Fatal(err)
+		}
+		// the greeting answer and the reply, the conn is closed on a failure
+		reply := make([]byte, 12)
+		if _, err = io.ReadFull(conn, reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply[3] != Socks5Succeeded {
+			return reply[3]
+		}
+		b := make([]byte, 5)
+		if _, err = conn.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = io.ReadFull(conn, b); err != nil || string(b) != "hello" {
+			t.Fatalf("invalid echo %q: %v", b, err)
+		}
+		return reply[3]
+	}
+	if code := connect(input.Tunnels[0], "127.0.0.1"); code != Socks5Succeeded {
+		t.Fatalf("allowed destination refused with %v", code)
+	}
+	// the server refuses a destination outside its allow list, the tunnel does not ask it for one outside its own
+	if code := connect(input.Tunnels[0], "localhost"); code != Socks5NotAllowed {
+		t.Fatalf("destination outside the allow list opened with %v", code)
+	}
+	if code := connect(input.Tunnels[1], "localhost"); code != Socks5NotAllowed {
+		t.Fatalf("destination outside the tunnel allow list opened with %v", code)
+	}
+}
@@ -0,0 +1,198 @@
+package euphoria
+
+import (
+	"context"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type StreamEventClientConfig struct {
+	EventEncode         string `yaml:"EventEncode"`
+	BaseAddr            string `yaml:"BaseAddr"`
+	IdleInterval        int    `yaml:"IdleInterval"`
+	EventStreamGetPath  string `yaml:"EventStreamGetPath"`
+	EventStreamPostPath string `yaml:"EventStreamPostPath"`
+	KeepAlive           int    `yaml:"KeepAlive"`
+	SessionId           string `yaml:"SessionId"`
+	AuthToken           string `yaml:"AuthToken"`
+	SchedulerQuantum    int    `yaml:"SchedulerQuantum"`
+	MaxEventPostSize    int    `yaml:"MaxEventPostSize"`
+	MaxEventPostBytes   int    `yaml:"MaxEventPostBytes"`
+}
+
+// StreamEventClient carries the events of the client over two long-lived http requests,
+// it streams the events queued in Source in the body of a post and pushes the events
+// streamed in the response of a get to Next.
+type StreamEventClient struct {
+	Config    *StreamEventClientConfig
+	Logger    *logrus.Entry
+	Client    *http.Client
+	Source    EventQueue
+	Next      EventQueue
+	Cursor    *EventCursor
+	Cipher    *EventCipher
+	Scheduler *EventScheduler
+	Epoch     *EventEpoch // tells the conns when the server restarted, nil if nobody cares
+	mutex     sync.Mutex
+	post      *io.PipeWriter
+}
+
+func NewStreamEventClient(config *StreamEventClientConfig, client *http.Client, source EventQueue, next EventQueue, cipher *EventCipher) *StreamEventClient {
+	return &StreamEventClient{
+		Config:    config,
+		Logger:    logrus.WithField("Fm", "StreamEventClient"),
+		Client:    client,
+		Source:    source,
+		Next:      next,
+		Cursor:    &EventCursor{},
+		Cipher:    cipher,
+		Scheduler: NewEventScheduler(config.SchedulerQuantum, config.EventEncode),
+	}
+}
+
+func (m *StreamEventClient) Idle() {
+	time.Sleep(time.Millisecond * time.Duration(m.Config.IdleInterval))
+}
+
+func (m *StreamEventClient) Run() {
+	go func() {
+		for {
+			m.Send()
+		}
+	}()
+	for {
+		m.Retrieve()
+	}
+}
+
+// Send opens a post stream and writes the events queued in Source to it until the stream is cut.
+func (m *StreamEventClient) Send() {
+	reader, writer := io.Pipe()
+	request, err := http.NewRequest(http.MethodPost, m.Config.BaseAddr+m.Config.EventStreamPostPath, reader)
+	if err != nil {
+		m.Logger.WithError(err).Errorln("failed to make post request!")
+		m.Idle()
+		return
+	}
+	request.Header.Set("Content-Type", m.Config.EventEncode)
+	request.Header.Set(EventSessionHeader, m.Config.SessionId)
+	SetAuthToken(request.Header, m.Config.AuthToken)
+	m.mutex.Lock()
+	m.post = writer
+	m.mutex.Unlock()
+	go func() {
+		res, err := m.Client.Do(request)
+		if err == nil {
+			res.Body.Close()
+			err = errors.New("post stream closed with code " + strconv.Itoa(res.StatusCode))
+		}
+		_ = reader.CloseWithError(err)
+	}()
+	m.Logger.Info("post stream opened!")
+	var acked uint64
+	last := time.Now()
+	for {
+		// get events
+		// take a fair batch, the events left wait for the next frame
+		m.Source.Lock()
+		events, rest := m.Scheduler.Schedule(m.Source.Drain(), m.Config.MaxEventPostSize, MaxBatchBytes(m.Config.MaxEventPostBytes))
+		m.Source.Recovery(rest)
+		m.Source.Unlock()
+		cursor := m.Cursor.Load()
+		keepAlive := time.Until(last.Add(time.Millisecond * time.Duration(m.Config.KeepAlive)))
+		if len(events) == 0 && cursor == acked && keepAlive > 0 {
+			ctx, cancel := context.WithTimeout(context.Background(), keepAlive)
+			m.Cursor.Wait(ctx, m.Source, acked)
+			cancel()
+			continue
+		}
+		// write frame
+		err = WriteFrame(writer, m.Cipher, m.Config.SessionId, m.Config.EventEncode, &EventFrame{Ck: cursor, Ev: events})
+		if err != nil {
+			m.Logger.WithError(err).Errorln("failed to write post stream, do recovery!")
+			m.Source.Lock()
+			m.Source.Recovery(events)
+			m.Source.Unlock()
+			break
+		}
+		acked = cursor
+		last = time.Now()
+	}
+	_ = writer.Close()
+	m.Idle()
+}
+
+// Retrieve opens a get stream and pushes the events read from it to Next until the stream is cut.
+// The server writes at least every KeepAlive, a stream silent for twice as long is cut as well.
+func (m *StreamEventClient) Retrieve() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	expire := 2 * time.Millisecond * time.Duration(m.Config.KeepAlive)
+	var timer *time.Timer
+	if expire > 0 {
+		timer = time.AfterFunc(expire, cancel)
+		defer timer.Stop()
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, m.Config.BaseAddr+m.Config.EventStreamGetPath, nil)
+	if err != nil {
+		m.Logger.WithError(err).Errorln("failed to make get request!")
+		m.Idle()
+		return
+	}
+	request.Header.Set(EventSessionHeader, m.Config.SessionId)
+	SetAuthToken(request.Header, m.Config.AuthToken)
+	res, err := m.Client.Do(request)
+	if err != nil {
+		m.Logger.WithError(err).Errorln("failed to open get stream!")
+		m.Idle()
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		m.Logger.WithField("Code", res.StatusCode).Errorln("failed to open get stream!")
+		m.Idle()
+		return
+	}
+	m.Logger.Info("get stream opened!")
+	// the post stream may still be open to the previous server, what is written to it is lost
+	epoch := res.Header.Get(EventEpochHeader)
+	m.mutex.Lock()
+	if m.post != nil && m.Epoch.Changed(epoch) {
+		_ = m.post.CloseWithError(ErrServerRestarted)
+	}
+	m.mutex.Unlock()
+	m.Epoch.Observe(epoch)
+	for {
+		var frame EventFrame
+		err = ReadFrame(res.Body, m.Cipher, m.Config.SessionId, m.Config.EventEncode, &frame)
+		if err != nil {
+			m.Logger.WithError(err).Errorln("failed to read get stream!")
+			break
+		}
+		if timer != nil {
+			timer.Reset(expire)
+		}
+		// skip keep alive frames and batches already received
+		if frame.Ck == 0 {
+			continue
+		}
+		if frame.Ck <= m.Cursor.Load() {
+			m.Logger.Debugf("drop re-delivered batch %v", frame.Ck)
+			continue
+		}
+		m.Next.WaitSpace(context.Background(), "", "")
+		m.Next.Lock()
+		for _, event := range frame.Ev {
+			m.Next.Push(event)
+		}
+		m.Next.Unlock()
+		// wake up the sender to ack
+		m.Cursor.Store(frame.Ck)
+	}
+	m.Idle()
+}
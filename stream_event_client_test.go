@@ -0,0 +1,39 @@
+package euphoria
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStreamEventClientKeepAlive(t *testing.T) {
+	// a server that opens the get stream and never writes to it
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(http.StatusOK)
+		writer.(http.Flusher).Flush()
+		select {
+		case <-request.Context().Done():
+		case <-done:
+		}
+	}))
+	defer server.Close()
+	defer close(done)
+	client := NewStreamEventClient(&StreamEventClientConfig{
+		EventEncode:        "application/msgpack",
+		BaseAddr:           server.URL,
+		EventStreamGetPath: "/get",
+		KeepAlive:          50,
+	}, server.Client(), &EventQueueImpl{}, &EventQueueImpl{}, nil)
+	retrieved := make(chan struct{})
+	go func() {
+		client.Retrieve()
+		close(retrieved)
+	}()
+	select {
+	case <-retrieved:
+	case <-time.After(time.Second):
+		t.Fatal("silent get stream is not cut")
+	}
+}
@@ -0,0 +1,132 @@
+package euphoria
+
+import (
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"time"
+)
+
+type StreamEventEndpointConfig struct {
+	EventEncode         string   `yaml:"EventEncode"`
+	BasePath            string   `yaml:"BasePath"`
+	EventStreamGetPath  string   `yaml:"EventStreamGetPath"`
+	EventStreamPostPath string   `yaml:"EventStreamPostPath"`
+	KeepAlive           int      `yaml:"KeepAlive"`
+	AuthTokens          []string `yaml:"AuthTokens"`
+}
+
+// StreamEventEndpoint carries the events of a session over two long-lived http requests,
+// a post whose body streams the frames of the client and a get whose chunked response
+// streams the frames of the session.
+type StreamEventEndpoint struct {
+	Config     *StreamEventEndpointConfig
+	Logger     *logrus.Entry
+	HttpServer *http.ServeMux
+	Provider   *HttpEventProvider
+	Next       EventQueue
+	Cipher     *EventCipher
+}
+
+func NewStreamEventEndpoint(config *StreamEventEndpointConfig, httpServer *http.ServeMux, provider *HttpEventProvider, next EventQueue, cipher *EventCipher) *StreamEventEndpoint {
+	endpoint := &StreamEventEndpoint{
+		Config:     config,
+		Logger:     logrus.WithField("Fm", "StreamEventEndpoint"),
+		HttpServer: httpServer,
+		Provider:   provider,
+		Next:       next,
+		Cipher:     cipher,
+	}
+	endpoint.SetupHandler()
+	return endpoint
+}
+
+func (m *StreamEventEndpoint) SetupHandler() {
+	if m.Config.EventStreamGetPath == "" || m.Config.EventStreamPostPath == "" {
+		return
+	}
+	m.HttpServer.HandleFunc(m.Config.BasePath+m.Config.EventStreamGetPath, Authenticate(m.Config.AuthTokens, m.HttpEventStreamGetHandler()))
+	m.HttpServer.HandleFunc(m.Config.BasePath+m.Config.EventStreamPostPath, Authenticate(m.Config.AuthTokens, m.HttpEventStreamPostHandler()))
+}
+
+func (m *StreamEventEndpoint) HttpEventStreamGetHandler() http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		id := request.Header.Get(EventSessionHeader)
+		flusher, ok := writer.(http.Flusher)
+		if !ok {
+			m.Logger.Errorln("streaming is not supported!")
+			writer.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		writer.Header().Set("Content-Type", m.Config.EventEncode)
+		writer.Header().Set(EventEpochHeader, m.Provider.Epoch)
+		writer.WriteHeader(http.StatusOK)
+		flusher.Flush()
+		m.Logger.Infof("session %v get stream opened!", id)
+		// batches lost with a previous stream are delivered first
+		m.Provider.Lock()
+		m.Provider.Session(id).Rewind()
+		m.Provider.Unlock()
+		// and the conns retransmit what was lost with it
+		m.Provider.Resume(id)
+		ctx := request.Context()
+		for ctx.Err() == nil {
+			// the session stays alive as long as the stream
+			m.Provider.Lock()
+			m.Provider.Touch(m.Provider.Session(id))
+			m.Provider.Unlock()
+			// an empty frame keeps the stream alive through proxies
+			frame := &EventFrame{}
+			batch := m.Provider.WaitBatch(ctx, id, time.Millisecond*time.Duration(m.Config.KeepAlive), true)
+			if batch != nil {
+				frame.Ck = batch.Cursor
+				frame.Ev = batch.Events
+			}
+			err := WriteFrame(writer, m.Cipher, id, m.Config.EventEncode, frame)
+			if err != nil {
+				m.Logger.WithError(err).Debug("failed to write stream, batch will be re-delivered!")
+				break
+			}
+			flusher.Flush()
+		}
+		m.Logger.Infof("session %v get stream closed!", id)
+	}
+}
+
+func (m *StreamEventEndpoint) HttpEventStreamPostHandler() http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		id := request.Header.Get(EventSessionHeader)
+		m.Logger.Infof("session %v post stream opened!", id)
+		// events lost with a previous stream are retransmitted
+		m.Provider.Resume(id)
+		for {
+			var frame EventFrame
+			err := ReadFrame(request.Body, m.Cipher, id, m.Config.EventEncode, &frame)
+			if IsCipherError(err) {
+				m.Logger.WithError(err).Errorln("failed to decode frame, rejected!")
+				break
+			}
+			if err != nil {
+				m.Logger.WithError(err).Debug("failed to read stream!")
+				break
+			}
+			// apply ack
+			m.Provider.Lock()
+			session := m.Provider.Session(id)
+			m.Provider.Touch(session)
+			session.Acknowledge(frame.Ck)
+			m.Provider.Notify()
+			m.Provider.Unlock()
+			// send events
+			if !m.Next.WaitSpace(request.Context(), "", "") {
+				break
+			}
+			m.Next.Lock()
+			for _, event := range frame.Ev {
+				event.Ss = id
+				m.Next.Push(event)
+			}
+			m.Next.Unlock()
+		}
+		m.Logger.Infof("session %v post stream closed!", id)
+	}
+}
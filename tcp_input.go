@@ -1,29 +1,54 @@
 package euphoria
 
 import (
+	"context"
+	"errors"
 	"github.com/sirupsen/logrus"
 	"io"
 	"net"
 	"strings"
-	"sync"
+	"sync/atomic"
 	"time"
 )
 
+var ErrOpenTimeout = errors.New("open remote timeout")
+
 type TcpInputConfig struct {
-	ListenAddr     string `yaml:"ListenAddr"`
-	ReadBufferSize int    `yaml:"ReadBufferSize"`
-	IdleInterval   int    `yaml:"IdleInterval"`
-	OpenTimeout    int    `yaml:"OpenTimeout"`
+	ListenAddr      string            `yaml:"ListenAddr"`
+	Tunnels         []TcpTunnelConfig `yaml:"Tunnels"`
+	ReadBufferSize  int               `yaml:"ReadBufferSize"`
+	OpenTimeout     int               `yaml:"OpenTimeout"`
+	QueueLimit      EventQueueLimit   `yaml:"QueueLimit"`
+	QueueLog        EventLogConfig    `yaml:"QueueLog"`
+	Window          int               `yaml:"Window"`
+	ShutdownTimeout int               `yaml:"ShutdownTimeout"`
+}
+
+// TcpTunnelConfig is a local listen address whose conns are opened to the destination
+// called Name on the other side. With Mode "socks5" or "http" the destination is requested
+// by each conn instead, it must match AllowList if set and Credentials are "user:password"
+// the conn must authenticate with if set. Session is the client session a tunnel listening on
+// the server is opened through.
+type TcpTunnelConfig struct {
+	Name        string   `yaml:"Name"`
+	ListenAddr  string   `yaml:"ListenAddr"`
+	Session     string   `yaml:"Session"`
+	Mode        string   `yaml:"Mode"`
+	AllowList   []string `yaml:"AllowList"`
+	Credentials []string `yaml:"Credentials"`
+}
+
+type TcpTunnel struct {
+	Config   *TcpTunnelConfig
+	Listener net.Listener
+	Frontend TcpFrontend
 }
 
 type TcpInput struct {
 	EventQueueImpl
-	Config        *TcpInputConfig
-	Logger        *logrus.Entry
-	Listener      net.Listener
-	Registry      map[string]*Connect
-	RegistryMutex sync.RWMutex
-	Next          EventQueue
+	TcpRegistry
+	Config  *TcpInputConfig
+	Tunnels []*TcpTunnel
 }
 
 func NewTcpInput(config *TcpInputConfig, next EventQueue) *TcpInput {
@@ -31,106 +56,196 @@ func NewTcpInput(config *TcpInputConfig, next EventQueue) *TcpInput {
 	L := logrus.WithField("Fm", "NewTcpInput")
 	// create instance
 	tcpInput := &TcpInput{
-		EventQueueImpl: EventQueueImpl{},
-		Config:         config,
-		Logger:         logrus.WithField("Fm", "TcpInput"),
-		Listener:       nil,
-		Registry:       make(map[string]*Connect),
-		RegistryMutex:  sync.RWMutex{},
-		Next:           next,
-	}
-	// create listener
-	tcpListener, err := net.Listen("tcp", config.ListenAddr)
-	if err != nil {
-		L.WithError(err).Fatalln("failed to do tcp listen!")
+		EventQueueImpl: EventQueueImpl{Limit: config.QueueLimit},
+		TcpRegistry: TcpRegistry{
+			Logger:          logrus.WithField("Fm", "TcpInput"),
+			Registry:        make(map[string]*Connect),
+			Next:            next,
+			Window:          WindowSize(config.Window),
+			ShutdownTimeout: config.ShutdownTimeout,
+		},
+		Config:  config,
+		Tunnels: nil,
+	}
+	if err := tcpInput.OpenLog(&config.QueueLog, "tcp-input"); err != nil {
+		L.WithError(err).Fatalln("failed to open queue log!")
+	}
+	// create listeners, ListenAddr is the tunnel to the default destination
+	tunnels := config.Tunnels
+	if config.ListenAddr != "" {
+		tunnels = append([]TcpTunnelConfig{{Name: "", ListenAddr: config.ListenAddr}}, tunnels...)
+	}
+	for i := range tunnels {
+		frontend, err := NewTcpFrontend(&tunnels[i])
+		if err != nil {
+			L.WithError(err).Fatalln("failed to make tunnel front-end!")
+		}
+		tcpListener, err := net.Listen("tcp", tunnels[i].ListenAddr)
+		if err != nil {
+			L.WithError(err).Fatalln("failed to do tcp listen!")
+		}
+		tcpInput.Tunnels = append(tcpInput.Tunnels, &TcpTunnel{
+			Config:   &tunnels[i],
+			Listener: tcpListener,
+			Frontend: frontend,
+		})
 	}
-	tcpInput.Listener = tcpListener
 
 	return tcpInput
 }
 
-func (m *TcpInput) Idle() {
-	time.Sleep(time.Millisecond * time.Duration(m.Config.IdleInterval))
-}
-
-func (m *TcpInput) HandleConn(conn net.Conn) {
+func (m *TcpInput) HandleConn(conn net.Conn, tunnel *TcpTunnel) {
+	// negotiate destination
+	request := &FrontendRequest{Destination: tunnel.Config.Name}
+	if tunnel.Frontend != nil {
+		var err error
+		_ = conn.SetDeadline(time.Now().Add(time.Millisecond * time.Duration(m.Config.OpenTimeout)))
+		request, err = tunnel.Frontend.Handshake(conn)
+		_ = conn.SetDeadline(time.Time{})
+		if err != nil {
+			m.Logger.WithError(err).Errorf("failed to handshake with conn %v!", conn.RemoteAddr())
+			conn.Close()
+			return
+		}
+		if len(tunnel.Config.AllowList) > 0 && !MatchAddr(tunnel.Config.AllowList, request.Destination) {
+			m.Logger.Warnf("conn %v is not allowed to open %v!", conn.RemoteAddr(), request.Destination)
+			_ = tunnel.Frontend.Reply(conn, request, ErrAddrNotAllowed)
+			conn.Close()
+			return
+		}
+	}
 	// add conn to registry
 	m.RegistryMutex.Lock()
 	defer m.RegistryMutex.Unlock()
-	connect := &Connect{
-		Conn:  conn,
-		From:  conn.RemoteAddr().String(),
-		To:    "",
-		Ready: make(chan bool),
-	}
-	m.Registry[conn.RemoteAddr().String()] = connect
+	connect := NewConnect(conn, NewConnectId(), "")
+	connect.Addr = conn.RemoteAddr().String()
+	connect.Session = tunnel.Config.Session
+	m.Registry[connect.From] = connect
 	// log
-	m.Logger.WithField("Alive", len(m.Registry)).Infof("conn %v connected!", conn.RemoteAddr())
-	// send open event
-	openEvent := &Event{
+	m.Logger.WithField("Alive", len(m.Registry)).Infof("conn %v from %v connected to %q!", connect.From, connect.Addr, request.Destination)
+	// send open event, it carries the destination
+	openEvent := connect.Stamp(&Event{
 		Nm: "TcpOpen",
 		To: "",
 		Fm: connect.From,
 		Tm: time.Now().UnixNano(),
-		Dt: nil,
-	}
+		Dt: []byte(request.Destination),
+	})
 	m.Next.Lock()
 	m.Next.Push(openEvent)
 	m.Next.Unlock()
-	// poll conn
-	go m.Poll(connect)
+	// write and poll conn
+	go m.Write(connect)
+	go m.Poll(connect, tunnel, request)
 }
 
-func (m *TcpInput) Poll(connect *Connect) {
+func (m *TcpInput) Poll(connect *Connect, tunnel *TcpTunnel, request *FrontendRequest) {
 	defer func() {
-		connect.Conn.Close()
+		connect.Close()
 		// remove from registry
 		m.RegistryMutex.Lock()
 		defer m.RegistryMutex.Unlock()
 		delete(m.Registry, connect.From)
 		m.Logger.Debugf("conn %v removed from registry", connect.From)
 		// send close event
-		closeEvent := &Event{
+		closeEvent := connect.Stamp(&Event{
 			Nm: "TcpClose",
 			To: connect.To,
 			Fm: connect.From,
 			Tm: time.Now().UnixNano(),
 			Dt: nil,
-		}
+		})
+		m.Next.Lock()
 		m.Next.Push(closeEvent)
+		m.Next.Unlock()
 		// log
-		m.Logger.WithField("Alive", len(m.Registry)).Infof("conn %v closed!", connect.Conn.RemoteAddr().String())
+		m.Logger.WithField("Alive", len(m.Registry)).Infof("conn %v from %v closed!", connect.From, connect.Addr)
 	}()
-	L := m.Logger.WithField("TcpFrom", connect.From).WithField("TcpTo", connect.To)
+	// the peer of the conn is only known once it is opened
+	L := m.Logger.WithField("TcpFrom", connect.From)
 	// sync open event
 	select {
 	case <-time.After(time.Millisecond * time.Duration(m.Config.OpenTimeout)):
 		m.Logger.WithField("ConnFrom", connect.From).Warn("open remote timeout!")
+		if tunnel.Frontend != nil {
+			_ = tunnel.Frontend.Reply(connect.Conn, request, ErrOpenTimeout)
+		}
 		return
-	case <-connect.Ready:
+	case err := <-connect.Ready:
+		if err != nil {
+			L.WithError(err).Warnf("failed to open remote %q!", request.Destination)
+			if tunnel.Frontend != nil {
+				_ = tunnel.Frontend.Reply(connect.Conn, request, err)
+			}
+			return
+		}
 		L.Debug("sync done!")
 	}
+	if tunnel.Frontend != nil {
+		err := tunnel.Frontend.Reply(connect.Conn, request, nil)
+		if err != nil {
+			m.Logger.WithError(err).Errorln("failed to reply conn!")
+			return
+		}
+	}
+	// advertise the bytes the conn accepts
+	m.SendWindow(connect, int64(m.Window))
+	// send data read by the front-end, it is sent ahead of the credit
+	if len(request.Data) > 0 {
+		connect.Spend(int64(len(request.Data)))
+		dataEvent := connect.Stamp(&Event{
+			Nm: "TcpData",
+			To: connect.To,
+			Fm: connect.From,
+			Tm: time.Now().UnixNano(),
+			Dt: request.Data,
+		})
+		m.Next.Lock()
+		m.Next.Push(dataEvent)
+		m.Next.Unlock()
+	}
 	// poll
 	buf := make([]byte, m.Config.ReadBufferSize)
 	for {
+		// stop reading while the next queue is full or the peer accepts no more bytes
+		if !m.Next.WaitSpace(connect.Context, connect.Session, connect.From) {
+			break
+		}
+		credit := connect.WaitCredit()
+		if credit == 0 {
+			break
+		}
 		// read data
-		n, err := connect.Conn.Read(buf[:])
+		size := len(buf)
+		if credit < int64(size) {
+			size = int(credit)
+		}
+		n, err := connect.Conn.Read(buf[:size])
+		if err == io.EOF {
+			// the peer only stops writing, the conn is closed once it is done reading too
+			if m.SendShutdown(connect) {
+				break
+			}
+			m.Linger(connect)
+			break
+		}
 		if err != nil {
-			if err != io.EOF && !strings.Contains(err.Error(), "use of closed network connection") {
+			if !strings.Contains(err.Error(), "use of closed network connection") {
 				m.Logger.WithError(err).Errorln("failed to read conn!")
 			}
 			break
 		}
+		connect.Spend(int64(n))
 		// send data event
 		eventData := make([]byte, n)
 		copy(eventData, buf[:n])
-		dataEvent := &Event{
+		dataEvent := connect.Stamp(&Event{
 			Nm: "TcpData",
 			To: connect.To,
 			Fm: connect.From,
 			Tm: time.Now().UnixNano(),
 			Dt: eventData,
-		}
+		})
 		m.Next.Lock()
 		m.Next.Push(dataEvent)
 		m.Next.Unlock()
@@ -138,39 +253,61 @@ func (m *TcpInput) Poll(connect *Connect) {
 }
 
 func (m *TcpInput) HandleEvents() {
-	for {
-		// check event queue
-		m.Lock()
-		empty := m.Empty()
-		m.Unlock()
-		if empty {
-			m.Idle()
-			continue
-		}
+	for m.Wait(context.Background()) {
 		// get events
-		var events []*Event
 		m.Lock()
-		for !m.Empty() {
-			events = append(events, m.Front())
-			m.Pop()
-		}
+		events := m.Drain()
 		m.Unlock()
-		// process events
+		// process events in sequence order
 		for _, event := range events {
-			switch event.Nm {
-			case "TcpOpen":
-				m.HandleOpenEvent(event)
-			case "TcpData":
-				m.HandleDataEvent(event)
-			case "TcpClose":
-				m.HandleCloseEvent(event)
-			default:
-				m.Logger.Errorf("invalid event type: %v", event.Nm)
+			for _, event := range m.Sequence(event) {
+				switch event.Nm {
+				case "TcpOpen":
+					m.HandleOpenEvent(event)
+				case "TcpData":
+					m.HandleDataEvent(event)
+				case "TcpWindow":
+					m.HandleWindowEvent(event)
+				case "TcpOpenFailed":
+					m.HandleOpenFailedEvent(event)
+				case "TcpResume":
+					m.HandleResumeEvent(event)
+				case "TcpShutdown":
+					m.HandleShutdownEvent(event)
+				case "TcpClose":
+					m.HandleCloseEvent(event)
+				default:
+					m.Logger.Errorf("invalid event type: %v", event.Nm)
+				}
 			}
 		}
 	}
 }
 
+// Sequence passes event through the reorder buffer of its conn, open events and events
+// of unknown conns are passed as they are.
+func (m *TcpInput) Sequence(event *Event) []*Event {
+	if event.Nm == "TcpOpen" {
+		return []*Event{event}
+	}
+	m.RegistryMutex.RLock()
+	connect, exist := m.Registry[event.To]
+	m.RegistryMutex.RUnlock()
+	if !exist {
+		return []*Event{event}
+	}
+	if connect.Session != "" && connect.Session != event.Ss {
+		m.Logger.Warnf("drop event of session %v for conn of session %v!", event.Ss, connect.Session)
+		return nil
+	}
+	events, err := connect.Accept(event, m.Window)
+	if err != nil {
+		m.Logger.WithError(err).Errorf("conn %v falls too far behind its peer, close it!", connect.From)
+		connect.Close()
+	}
+	return events
+}
+
 func (m *TcpInput) HandleOpenEvent(event *Event) {
 	L := m.Logger.WithField("TcpFrom", event.Fm).WithField("TcpTo", event.To)
 	L.Debug("open event received!")
@@ -182,58 +319,56 @@ func (m *TcpInput) HandleOpenEvent(event *Event) {
 		L.Debug("cannot find conn in registry")
 		return
 	}
+	if connect.To != "" {
+		L.Debug("drop duplicated open event")
+		return
+	}
+	if connect.Session != "" && connect.Session != event.Ss {
+		L.Warnf("drop open event of session %v!", event.Ss)
+		return
+	}
 	// process event
 	connect.To = event.Fm
-	connect.Ready <- true
+	atomic.StoreUint64(&connect.RecvSeq, event.Sq)
+	connect.Ready <- nil
 }
 
-func (m *TcpInput) HandleDataEvent(event *Event) {
-	L := m.Logger.WithField("TcpFrom", event.Fm).WithField("TcpTo", event.To)
-	L.Debugf("data event received! data size: %v", len(event.Dt))
+func (m *TcpInput) HandleOpenFailedEvent(event *Event) {
+	L := m.Logger.WithField("TcpTo", event.To)
 	m.RegistryMutex.Lock()
+	defer m.RegistryMutex.Unlock()
 	// check registry
 	connect, exist := m.Registry[event.To]
-	m.RegistryMutex.Unlock()
 	if !exist {
 		L.Debug("cannot find conn in registry")
 		return
 	}
-	// process event
-	n, err := connect.Conn.Write(event.Dt[:])
-	// TODO comment
-	//fmt.Println("===ti===")
-	//fmt.Println(string(event.Dt[:]))
-	if err != nil {
-		L.Error("failed to write conn!")
+	if connect.To != "" || (connect.Session != "" && connect.Session != event.Ss) {
+		L.Debug("drop open failed event")
 		return
 	}
-	L.Debugf("write %v bytes to conn!", n)
+	// process event, the conn is closed by its poll
+	select {
+	case connect.Ready <- OpenFailedError(event.Dt):
+	default:
+	}
 }
 
-func (m *TcpInput) HandleCloseEvent(event *Event) {
-	L := m.Logger.WithField("TcpFrom", event.Fm).WithField("TcpTo", event.To)
-	L.Debug("close event received!")
-	m.RegistryMutex.Lock()
-	defer m.RegistryMutex.Unlock()
-	// check registry
-	connect, exist := m.Registry[event.To]
-	if !exist {
-		L.Debug("cannot find conn in registry")
-		return
+func (m *TcpInput) Run() {
+	for _, tunnel := range m.Tunnels {
+		go m.Accept(tunnel)
 	}
-	// process event
-	connect.Conn.Close()
+	m.HandleEvents()
 }
 
-func (m *TcpInput) Run() {
-	m.Logger.Infof("listen at: %v", m.Config.ListenAddr)
-	go m.HandleEvents()
+func (m *TcpInput) Accept(tunnel *TcpTunnel) {
+	m.Logger.Infof("tunnel %q listen at: %v", tunnel.Config.Name, tunnel.Config.ListenAddr)
 	for {
-		conn, err := m.Listener.Accept()
+		conn, err := tunnel.Listener.Accept()
 		if err != nil {
 			m.Logger.WithError(err).Errorln("failed to accept conn!")
 			continue
 		}
-		go m.HandleConn(conn)
+		go m.HandleConn(conn, tunnel)
 	}
 }
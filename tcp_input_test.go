@@ -0,0 +1,97 @@
+package euphoria
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTcpInputConnectId(t *testing.T) {
+	dest, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dest.Close()
+	go func() {
+		for {
+			conn, err := dest.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+	// clients share one server output, which sends the events of a conn to the client holding it
+	serverOut := &EventQueueImpl{}
+	server := NewTcpOutput(&TcpOutputConfig{DestAddr: dest.Addr().String(), ReadBufferSize: 1024}, serverOut)
+	go server.Run()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var routes []EventRoute
+	client := func(session string) *TcpInput {
+		clientOut := &EventQueueImpl{}
+		input := NewTcpInput(&TcpInputConfig{
+			Tunnels:        []TcpTunnelConfig{{ListenAddr: "127.0.0.1:0", Session: session}},
+			ReadBufferSize: 1024,
+			OpenTimeout:    1000,
+		}, clientOut)
+		go input.Run()
+		go pump(ctx, clientOut, server)
+		routes = append(routes, EventRoute{
+			Match: func(event *Event) bool {
+				input.RegistryMutex.RLock()
+				defer input.RegistryMutex.RUnlock()
+				_, exist := input.Registry[event.To]
+				return exist
+			},
+			Next: input,
+		})
+		return input
+	}
+	a, b := client("a"), client("b")
+	router := NewEventRouter()
+	go pump(ctx, serverOut, router)
+	open := func(input *TcpInput) net.Conn {
+		router.Lock()
+		router.Routes = routes
+		router.Unlock()
+		conn, err := net.Dial("tcp", input.Tunnels[0].Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	echo := func(conn net.Conn, data string) {
+		_ = conn.SetDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, len(data))
+		if _, err := io.ReadFull(conn, b); err != nil || string(b) != data {
+			t.Fatalf("invalid echo %q: %v", b, err)
+		}
+	}
+	conns := []net.Conn{open(a), open(b)}
+	// a restarted client keeps its session while the server still holds the conns of before
+	conns = append(conns, open(client("a")))
+	for i, conn := range conns {
+		defer conn.Close()
+		echo(conn, string(rune('a'+i)))
+	}
+	ids := make(map[string]bool)
+	server.RegistryMutex.Lock()
+	for id, connect := range server.Registry {
+		ids[id], ids[connect.To] = true, true
+		for _, id := range []string{id, connect.To} {
+			if _, _, err := net.SplitHostPort(id); err == nil {
+				t.Fatalf("conn is known by its address %v", id)
+			}
+		}
+	}
+	server.RegistryMutex.Unlock()
+	if len(ids) != 2*len(conns) {
+		t.Fatalf("%v ids for %v conns", len(ids), len(conns))
+	}
+}
@@ -1,75 +1,157 @@
 package euphoria
 
 import (
+	"context"
 	"github.com/sirupsen/logrus"
 	"io"
 	"net"
 	"strings"
-	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type TcpOutputConfig struct {
-	DestAddr       string `yaml:"DestAddr"`
-	IdleInterval   int    `yaml:"IdleInterval"`
-	ReadBufferSize int    `yaml:"ReadBufferSize"`
+	DestAddr        string            `yaml:"DestAddr"`
+	Destinations    map[string]string `yaml:"Destinations"`
+	AllowList       []string          `yaml:"AllowList"`
+	ReadBufferSize  int               `yaml:"ReadBufferSize"`
+	QueueLimit      EventQueueLimit   `yaml:"QueueLimit"`
+	QueueLog        EventLogConfig    `yaml:"QueueLog"`
+	Window          int               `yaml:"Window"`
+	ShutdownTimeout int               `yaml:"ShutdownTimeout"`
+	DialTimeout     int               `yaml:"DialTimeout"`
+	DialRetries     int               `yaml:"DialRetries"`
+	DialRetryDelay  int               `yaml:"DialRetryDelay"`
+	OpenTimeout     int               `yaml:"OpenTimeout"` // ms the other side waits for an open, dials give up before
+}
+
+// DialBudget is the ms a dial takes at most with its retries.
+func (m *TcpOutputConfig) DialBudget() int {
+	return m.DialTimeout*(m.DialRetries+1) + m.DialRetryDelay*m.DialRetries
+}
+
+// ClampDialBudget shortens the dials until they give up before the open timeout, the retries
+// are dropped first.
+func (m *TcpOutputConfig) ClampDialBudget() {
+	for m.DialRetries > 0 && m.DialBudget() >= m.OpenTimeout {
+		m.DialRetries--
+	}
+	if m.DialBudget() >= m.OpenTimeout {
+		m.DialTimeout = m.OpenTimeout - 1
+	}
 }
 
 type TcpOutput struct {
 	EventQueueImpl
-	Config        *TcpOutputConfig
-	Logger        *logrus.Entry
-	Registry      map[string]*Connect
-	RegistryMutex sync.Mutex
-	Next          EventQueue
+	TcpRegistry
+	Config  *TcpOutputConfig
+	Dialing map[string]context.CancelFunc // cancels the dials of open events by session and conn
 }
 
 func NewTcpOutput(config *TcpOutputConfig, next EventQueue) *TcpOutput {
+	// a dial outliving the open timeout opens a conn the other side already gave up
+	if config.OpenTimeout > 0 && config.DialBudget() >= config.OpenTimeout {
+		logrus.WithField("Fm", "NewTcpOutput").Warnf("dials take up to %v ms, beyond the open timeout of %v ms, shorten them!", config.DialBudget(), config.OpenTimeout)
+		config.ClampDialBudget()
+	}
 	tcpOutput := &TcpOutput{
-		EventQueueImpl: EventQueueImpl{},
-		Config:         config,
-		Logger:         logrus.WithField("Fm", "TcpOutput"),
-		Registry:       make(map[string]*Connect),
-		RegistryMutex:  sync.Mutex{},
-		Next:           next,
+		EventQueueImpl: EventQueueImpl{Limit: config.QueueLimit},
+		TcpRegistry: TcpRegistry{
+			Logger:          logrus.WithField("Fm", "TcpOutput"),
+			Registry:        make(map[string]*Connect),
+			Next:            next,
+			Window:          WindowSize(config.Window),
+			ShutdownTimeout: config.ShutdownTimeout,
+			Reply:           true,
+		},
+		Config:  config,
+		Dialing: make(map[string]context.CancelFunc),
+	}
+	if err := tcpOutput.OpenLog(&config.QueueLog, "tcp-output"); err != nil {
+		logrus.WithField("Fm", "NewTcpOutput").WithError(err).Fatalln("failed to open queue log!")
 	}
 	return tcpOutput
 }
 
-func (m *TcpOutput) Idle() {
-	time.Sleep(time.Millisecond * time.Duration(m.Config.IdleInterval))
-}
-
 func (m *TcpOutput) Update() {
-	// check event queue
-	m.Lock()
-	empty := m.Empty()
-	m.Unlock()
-	if empty {
-		m.Idle()
+	// wait for events
+	if !m.Wait(context.Background()) {
 		return
 	}
-	// get event
-	var events []*Event
 	m.Lock()
-	for !m.Empty() {
-		events = append(events, m.Front())
-		m.Pop()
-	}
+	events := m.Drain()
 	m.Unlock()
-	// process events
+	// process events in sequence order
 	for i := 0; i < len(events); i++ {
-		switch events[i].Nm {
-		case "TcpOpen":
-			m.HandleOpenEvent(events[i])
-		case "TcpData":
-			m.HandleDataEvent(events[i])
-		case "TcpClose":
-			m.HandleCloseEvent(events[i])
-		default:
-			m.Logger.Errorf("invalid event type: %v", events[i].Nm)
+		for _, event := range m.Sequence(events[i]) {
+			switch event.Nm {
+			case "TcpOpen":
+				m.HandleOpenEvent(event)
+			case "TcpData":
+				m.HandleDataEvent(event)
+			case "TcpWindow":
+				m.HandleWindowEvent(event)
+			case "TcpResume":
+				m.HandleResumeEvent(event)
+			case "TcpShutdown":
+				m.HandleShutdownEvent(event)
+			case "TcpClose":
+				m.HandleCloseEvent(event)
+			default:
+				m.Logger.Errorf("invalid event type: %v", event.Nm)
+			}
+		}
+	}
+}
+
+// Sequence passes event through the reorder buffer of its conn, open events and events
+// of unknown conns are passed as they are.
+func (m *TcpOutput) Sequence(event *Event) []*Event {
+	if event.Nm == "TcpOpen" {
+		return []*Event{event}
+	}
+	m.RegistryMutex.RLock()
+	connect, exist := m.Registry[event.To]
+	m.RegistryMutex.RUnlock()
+	if !exist {
+		return []*Event{event}
+	}
+	if connect.Session != "" && connect.Session != event.Ss {
+		m.Logger.Warnf("drop event of session %v for conn of session %v!", event.Ss, connect.Session)
+		return nil
+	}
+	events, err := connect.Accept(event, m.Window)
+	if err != nil {
+		m.Logger.WithError(err).Errorf("conn %v falls too far behind its peer, close it!", connect.From)
+		connect.Close()
+	}
+	return events
+}
+
+// Destination resolves the destination of an open event to its address. The destination is
+// either a name in Destinations, the empty name being DestAddr, or a host:port requested by
+// the client which must match AllowList.
+func (m *TcpOutput) Destination(name string) (string, bool) {
+	if name == "" {
+		return m.Config.DestAddr, m.Config.DestAddr != ""
+	}
+	addr, exist := m.Config.Destinations[name]
+	if exist {
+		return addr, true
+	}
+	return name, MatchAddr(m.Config.AllowList, name)
+}
+
+// Lookup finds the conn opened on behalf of the remote conn from of session.
+func (m *TcpOutput) Lookup(session string, from string) *Connect {
+	m.RegistryMutex.Lock()
+	defer m.RegistryMutex.Unlock()
+	for _, connect := range m.Registry {
+		if connect.Session == session && connect.To == from {
+			return connect
 		}
 	}
+	return nil
 }
 
 func (m *TcpOutput) Run() {
@@ -80,45 +162,70 @@ func (m *TcpOutput) Run() {
 
 func (m *TcpOutput) Poll(connect *Connect) {
 	defer func() {
-		connect.Conn.Close()
+		connect.Close()
 		// remove from registry
 		m.RegistryMutex.Lock()
 		defer m.RegistryMutex.Unlock()
 		delete(m.Registry, connect.From)
 		m.Logger.Debugf("conn %v removed from registry", connect.From)
 		// send close event
-		closeEvent := &Event{
+		closeEvent := connect.Stamp(&Event{
 			Nm: "TcpClose",
 			To: connect.To,
 			Fm: connect.From,
 			Tm: time.Now().UnixNano(),
+			Rp: true,
 			Dt: nil,
-		}
+		})
+		m.Next.Lock()
 		m.Next.Push(closeEvent)
+		m.Next.Unlock()
 		m.Logger.WithField("Alive", len(m.Registry)).Infof("conn %v closed!", connect.To)
 	}()
 	// poll
 	buf := make([]byte, m.Config.ReadBufferSize)
 	for {
+		// stop reading while the next queue is full or the peer accepts no more bytes
+		if !m.Next.WaitSpace(connect.Context, connect.Session, connect.From) {
+			break
+		}
+		credit := connect.WaitCredit()
+		if credit == 0 {
+			break
+		}
 		// read data
-		n, err := connect.Conn.Read(buf[:])
+		size := len(buf)
+		if credit < int64(size) {
+			size = int(credit)
+		}
+		n, err := connect.Conn.Read(buf[:size])
+		if err == io.EOF {
+			// the peer only stops writing, the conn is closed once it is done reading too
+			if m.SendShutdown(connect) {
+				break
+			}
+			m.Linger(connect)
+			break
+		}
 		if err != nil {
-			if err != io.EOF && !strings.Contains(err.Error(), "use of closed network connection") {
+			if !strings.Contains(err.Error(), "use of closed network connection") {
 				m.Logger.WithError(err).Errorln("failed to read conn!")
 			}
 			break
 		}
-		m.Logger.Debugf("read %v bytes form %v", n, connect.Conn.RemoteAddr().String())
+		connect.Spend(int64(n))
+		m.Logger.Debugf("read %v bytes form %v", n, connect.Addr)
 		eventData := make([]byte, n)
 		copy(eventData, buf[:n])
 		// send data event
-		dataEvent := &Event{
+		dataEvent := connect.Stamp(&Event{
 			Nm: "TcpData",
 			To: connect.To,
 			Fm: connect.From,
 			Tm: time.Now().UnixNano(),
+			Rp: true,
 			Dt: eventData,
-		}
+		})
 		m.Next.Lock()
 		m.Next.Push(dataEvent)
 		m.Next.Unlock()
@@ -128,52 +235,137 @@ func (m *TcpOutput) Poll(connect *Connect) {
 func (m *TcpOutput) HandleOpenEvent(event *Event) {
 	L := m.Logger.WithField("TcpFrom", event.Fm).WithField("TcpTo", event.To)
 	L.Debug("open event received!")
-	// dial to dest
-	conn, err := net.Dial("tcp", m.Config.DestAddr)
-	if err != nil {
-		m.Logger.WithError(err).Error("failed to dial to dest!")
+	// drop duplicated open event
+	if m.Lookup(event.Ss, event.Fm) != nil {
+		L.Debug("drop duplicated open event")
 		return
 	}
-	// make conn and add it to registry
-	connect := &Connect{
-		Conn:  conn,
-		From:  conn.LocalAddr().String(),
-		To:    event.Fm,
-		Ready: nil,
+	m.RegistryMutex.Lock()
+	if _, dialing := m.Dialing[event.Ss+"/"+event.Fm]; dialing {
+		m.RegistryMutex.Unlock()
+		L.Debug("drop duplicated open event")
+		return
+	}
+	// the dial is given up by a close of the origin or once the origin gave up anyway
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if m.Config.OpenTimeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond*time.Duration(m.Config.OpenTimeout))
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	m.Dialing[event.Ss+"/"+event.Fm] = cancel
+	m.RegistryMutex.Unlock()
+	addr, exist := m.Destination(string(event.Dt))
+	if !exist {
+		L.Warnf("destination %q is not allowed!", string(event.Dt))
+		m.OpenFailed(event, OpenFailedNotAllowed)
+		return
+	}
+	// dial to dest without holding up the events of other conns
+	go m.Dial(ctx, event, addr)
+}
+
+// Dial opens the conn of an open event to addr, a failed dial is retried DialRetries times.
+// The dial is given up once ctx is done, as the origin closed the conn or gave up waiting.
+func (m *TcpOutput) Dial(ctx context.Context, event *Event, addr string) {
+	L := m.Logger.WithField("TcpFrom", event.Fm).WithField("TcpTo", event.To)
+	dialer := &net.Dialer{Timeout: time.Millisecond * time.Duration(m.Config.DialTimeout)}
+	var conn net.Conn
+	var err error
+	for retry := 0; ; retry++ {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+		if err == nil || retry >= m.Config.DialRetries || ctx.Err() != nil {
+			break
+		}
+		L.WithError(err).Warnf("failed to dial to dest %v, retry %v!", addr, retry+1)
+		select {
+		case <-time.After(time.Millisecond * time.Duration(m.Config.DialRetryDelay)):
+		case <-ctx.Done():
+		}
+	}
+	if ctx.Err() != nil {
+		if conn != nil {
+			conn.Close()
+		}
+		L.Infof("dial to dest %v given up!", addr)
+		m.Dialed(event)
+		return
 	}
+	if err != nil {
+		L.WithError(err).Errorf("failed to dial to dest %v!", addr)
+		m.OpenFailed(event, OpenFailedReason(err))
+		return
+	}
+	// make conn and add it to registry, unless the dial was given up meanwhile
+	connect := NewConnect(conn, NewConnectId(), event.Fm)
+	connect.Addr = conn.RemoteAddr().String()
+	connect.Session = event.Ss
+	atomic.StoreUint64(&connect.RecvSeq, event.Sq)
 	m.RegistryMutex.Lock()
+	if !m.dialed(event) {
+		m.RegistryMutex.Unlock()
+		conn.Close()
+		L.Infof("dial to dest %v given up!", addr)
+		return
+	}
 	m.Registry[connect.From] = connect
+	alive := len(m.Registry)
 	m.RegistryMutex.Unlock()
 	// log
-	m.Logger.WithField("Alive", len(m.Registry)).Infof("conn %v connected!", event.Fm)
+	m.Logger.WithField("Alive", alive).Infof("conn %v connected to %v!", event.Fm, connect.Addr)
 	// make open event back to origin
-	openEvent := &Event{
+	openEvent := connect.Stamp(&Event{
 		Nm: "TcpOpen",
 		To: connect.To,
 		Fm: connect.From,
 		Tm: time.Now().UnixNano(),
+		Rp: true,
 		Dt: nil,
-	}
+	})
 	m.Next.Lock()
 	m.Next.Push(openEvent)
 	m.Next.Unlock()
-	// poll conn
-	go m.Poll(connect)
+	// advertise the bytes the conn accepts
+	m.SendWindow(connect, int64(m.Window))
+	// write and poll conn
+	go m.Write(connect)
+	m.Poll(connect)
 }
 
-func (m *TcpOutput) HandleDataEvent(event *Event) {
-	L := m.Logger.WithField("TcpFrom", event.Fm).WithField("TcpTo", event.To)
-	L.Debugf("data event received! data size: %v", len(event.Dt))
+// Dialed drops the dial of an open event.
+func (m *TcpOutput) Dialed(event *Event) {
 	m.RegistryMutex.Lock()
-	// check registry
-	connect, exist := m.Registry[event.To]
+	m.dialed(event)
 	m.RegistryMutex.Unlock()
-	if !exist {
-		L.Debug("cannot find conn in registry!")
-		return
+}
+
+// dialed drops the dial of an open event and tells if it was still going on, it is called with
+// the registry lock held.
+func (m *TcpOutput) dialed(event *Event) bool {
+	cancel, dialing := m.Dialing[event.Ss+"/"+event.Fm]
+	if dialing {
+		cancel()
+		delete(m.Dialing, event.Ss+"/"+event.Fm)
+	}
+	return dialing
+}
+
+// OpenFailed tells the origin of an open event its conn could not be opened for reason.
+func (m *TcpOutput) OpenFailed(event *Event, reason byte) {
+	m.Dialed(event)
+	failedEvent := &Event{
+		Nm: "TcpOpenFailed",
+		To: event.Fm,
+		Fm: "",
+		Tm: time.Now().UnixNano(),
+		Ss: event.Ss,
+		Rp: true,
+		Dt: []byte{reason},
 	}
-	// process event
-	_, _ = connect.Conn.Write(event.Dt[:])
+	m.Next.Lock()
+	m.Next.Push(failedEvent)
+	m.Next.Unlock()
 }
 
 func (m *TcpOutput) HandleCloseEvent(event *Event) {
@@ -184,9 +376,14 @@ func (m *TcpOutput) HandleCloseEvent(event *Event) {
 	// check registry
 	connect, exist := m.Registry[event.To]
 	if !exist {
+		// the origin gave up before the conn was opened
+		if m.dialed(event) {
+			L.Debug("dial canceled!")
+			return
+		}
 		L.Debug("cannot find conn in registry")
 		return
 	}
-	// process event
-	connect.Conn.Close()
+	// process event once the data before it is written
+	m.Deliver(connect, event)
 }
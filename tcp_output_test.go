@@ -0,0 +1,120 @@
+package euphoria
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// pump moves the events of from to to until ctx is done, as a transport does.
+func pump(ctx context.Context, from *EventQueueImpl, to EventQueue) {
+	for from.Wait(ctx) {
+		from.Lock()
+		events := from.Drain()
+		from.Unlock()
+		to.Lock()
+		for _, event := range events {
+			to.Push(event)
+		}
+		to.Unlock()
+	}
+}
+
+func TestTcpOutputDestination(t *testing.T) {
+	// each destination greets with its name
+	listen := func(name string) net.Listener {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				_, _ = conn.Write([]byte(name))
+				conn.Close()
+			}
+		}()
+		return listener
+	}
+	a, b := listen("a"), listen("b")
+	defer a.Close()
+	defer b.Close()
+	inputOut := &EventQueueImpl{}
+	outputOut := &EventQueueImpl{}
+	input := NewTcpInput(&TcpInputConfig{
+		ListenAddr:     "127.0.0.1:0",
+		Tunnels:        []TcpTunnelConfig{{Name: "b", ListenAddr: "127.0.0.1:0"}, {Name: "c", ListenAddr: "127.0.0.1:0"}},
+		ReadBufferSize: 1024,
+		OpenTimeout:    100,
+	}, inputOut)
+	output := NewTcpOutput(&TcpOutputConfig{
+		DestAddr:       a.Addr().String(),
+		Destinations:   map[string]string{"b": b.Addr().String()},
+		ReadBufferSize: 1024,
+	}, outputOut)
+	if addr, exist := output.Destination("c"); exist {
+		t.Fatalf("unknown destination resolved to %v", addr)
+	}
+	go input.Run()
+	go output.Run()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go pump(ctx, inputOut, output)
+	go pump(ctx, outputOut, input)
+	greet := func(tunnel *TcpTunnel) string {
+		conn, err := net.Dial("tcp", tunnel.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		b, _ := io.ReadAll(conn)
+		return string(b)
+	}
+	// the default tunnel goes to DestAddr and a named one to its destination
+	if name := greet(input.Tunnels[0]); name != "a" {
+		t.Fatalf("default tunnel reached %q", name)
+	}
+	if name := greet(input.Tunnels[1]); name != "b" {
+		t.Fatalf("tunnel b reached %q", name)
+	}
+	// a tunnel without destination is refused
+	if name := greet(input.Tunnels[2]); name != "" {
+		t.Fatalf("tunnel c reached %q", name)
+	}
+}
+
+func TestTcpOutputSequence(t *testing.T) {
+	output := NewTcpOutput(&TcpOutputConfig{}, &EventQueueImpl{})
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	connect := NewConnect(conn, "c", "")
+	connect.Session = "a"
+	output.Registry["c"] = connect
+	// a session cannot send events to the conns of another session
+	if events := output.Sequence(&Event{Nm: "TcpData", To: "c", Sq: 1, Ss: "b"}); len(events) != 0 {
+		t.Fatalf("events of another session accepted: %v", events)
+	}
+	if events := output.Sequence(&Event{Nm: "TcpData", To: "c", Sq: 1, Ss: "a"}); len(events) != 1 {
+		t.Fatalf("events of the session dropped: %v", events)
+	}
+}
+
+func TestTcpOutputDialBudget(t *testing.T) {
+	// dials outliving the open timeout are shortened, the retries first
+	for _, config := range []*TcpOutputConfig{
+		{DialTimeout: 1000, DialRetries: 2, DialRetryDelay: 200, OpenTimeout: 3000},
+		{DialTimeout: 1000, DialRetries: 2, DialRetryDelay: 200, OpenTimeout: 2000},
+		{DialTimeout: 5000, DialRetries: 2, DialRetryDelay: 200, OpenTimeout: 3000},
+	} {
+		NewTcpOutput(config, &EventQueueImpl{})
+		if config.DialBudget() >= config.OpenTimeout || config.DialTimeout <= 0 {
+			t.Fatalf("dials take up to %v ms of %v ms", config.DialBudget(), config.OpenTimeout)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package euphoria
+
+import (
+	"github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+// DefaultShutdownTimeout is the ShutdownTimeout of a stage configured without one.
+const DefaultShutdownTimeout = 60000
+
+// TcpRegistry holds the conns of a tcp stage and handles the events the input and the output
+// handle alike. Reply tells if the events sent are replies, as the output sends to the side
+// that opened the conns.
+type TcpRegistry struct {
+	Logger        *logrus.Entry
+	Registry      map[string]*Connect
+	RegistryMutex sync.RWMutex
+	Next          EventQueue
+	Window        int // bytes a conn accepts from its peer
+	Reply         bool
+	// ms a conn read to its end waits for its peer to write before it is closed, 0 is the default
+	ShutdownTimeout int
+}
+
+// Find finds the conn of id in the registry.
+func (m *TcpRegistry) Find(id string) (*Connect, bool) {
+	m.RegistryMutex.RLock()
+	defer m.RegistryMutex.RUnlock()
+	connect, exist := m.Registry[id]
+	return connect, exist
+}
+
+// CloseSession closes every conn of session.
+func (m *TcpRegistry) CloseSession(session string) {
+	m.RegistryMutex.Lock()
+	defer m.RegistryMutex.Unlock()
+	for _, connect := range m.Registry {
+		if connect.Session == session {
+			connect.Close()
+		}
+	}
+}
+
+// send pushes event to the next queue.
+func (m *TcpRegistry) send(event *Event) {
+	m.Next.Lock()
+	m.Next.Push(event)
+	m.Next.Unlock()
+}
+
+func (m *TcpRegistry) HandleDataEvent(event *Event) {
+	L := m.Logger.WithField("TcpFrom", event.Fm).WithField("TcpTo", event.To)
+	L.Debugf("data event received! data size: %v", len(event.Dt))
+	connect, exist := m.Find(event.To)
+	if !exist {
+		L.Debug("cannot find conn in registry")
+		return
+	}
+	m.Deliver(connect, event)
+}
+
+// Deliver queues event to the writer of connect, a conn slow to write holds up none of the
+// events of the other conns. The events of a closed conn are dropped.
+func (m *TcpRegistry) Deliver(connect *Connect, event *Event) {
+	connect.Writes.Lock()
+	defer connect.Writes.Unlock()
+	if connect.Context.Err() != nil {
+		return
+	}
+	connect.Writes.Push(event)
+}
+
+// Write writes the events delivered to connect until it is closed. The bytes written are
+// granted back to the peer, so the events waiting are bounded by the window. The conn is
+// closed once the writer exits and the events left are dropped.
+func (m *TcpRegistry) Write(connect *Connect) {
+	defer func() {
+		connect.Close()
+		connect.Writes.Lock()
+		connect.Writes.Drain()
+		connect.Writes.Unlock()
+	}()
+	for connect.Writes.Wait(connect.Context) {
+		L := m.Logger.WithField("TcpFrom", connect.From).WithField("TcpTo", connect.To)
+		connect.Writes.Lock()
+		events := connect.Writes.Drain()
+		connect.Writes.Unlock()
+		for _, event := range events {
+			switch event.Nm {
+			case "TcpData":
+				n, err := connect.Conn.Write(event.Dt)
+				if err != nil {
+					L.WithError(err).Debug("failed to write conn, close it!")
+					return
+				}
+				L.Debugf("write %v bytes to conn!", n)
+				connect.Touch()
+				// an empty grant acknowledges the events received when there is nothing else to send
+				if grant := connect.Consume(n, m.Window); grant > 0 || connect.AckDue() {
+					m.SendWindow(connect, grant)
+				}
+			case "TcpShutdown":
+				// the conn is closed once it is done both ways
+				if connect.CloseWrite() {
+					return
+				}
+			case "TcpClose":
+				return
+			}
+		}
+	}
+}
+
+func (m *TcpRegistry) HandleWindowEvent(event *Event) {
+	connect, exist := m.Find(event.To)
+	if !exist {
+		return
+	}
+	connect.Grant(DecodeWindow(event.Dt))
+}
+
+// SendWindow grants the peer of connect n more bytes.
+func (m *TcpRegistry) SendWindow(connect *Connect, n int64) {
+	m.send(connect.Stamp(&Event{
+		Nm: "TcpWindow",
+		To: connect.To,
+		Fm: connect.From,
+		Tm: time.Now().UnixNano(),
+		Rp: m.Reply,
+		Dt: EncodeWindow(n),
+	}))
+}
+
+// Resume asks the peer of every conn of session for its position, both sides then retransmit
+// the events the other side missed.
+func (m *TcpRegistry) Resume(session string) {
+	var connects []*Connect
+	m.RegistryMutex.RLock()
+	for _, connect := range m.Registry {
+		if connect.Session == session && connect.To != "" {
+			connects = append(connects, connect)
+		}
+	}
+	m.RegistryMutex.RUnlock()
+	for _, connect := range connects {
+		m.SendResume(connect, ResumeRequest)
+	}
+}
+
+// SendResume tells the peer of connect the last event received in order, kind is ResumeRequest
+// or ResumeReply.
+func (m *TcpRegistry) SendResume(connect *Connect, kind byte) {
+	m.send(&Event{
+		Nm: "TcpResume",
+		To: connect.To,
+		Fm: connect.From,
+		Tm: time.Now().UnixNano(),
+		Ss: connect.Session,
+		Ak: connect.Ack(),
+		Rp: m.Reply,
+		Dt: []byte{kind},
+	})
+}
+
+// HandleResumeEvent retransmits the events the peer did not acknowledge and answers a request
+// with the position of the conn. The peer of an unknown conn is told to close it.
+func (m *TcpRegistry) HandleResumeEvent(event *Event) {
+	L := m.Logger.WithField("TcpFrom", event.Fm).WithField("TcpTo", event.To)
+	request := len(event.Dt) == 1 && event.Dt[0] == ResumeRequest
+	connect, exist := m.Find(event.To)
+	if !exist {
+		if request {
+			L.Debug("cannot find conn in registry, close it on the peer")
+			m.send(&Event{
+				Nm: "TcpClose",
+				To: event.Fm,
+				Fm: event.To,
+				Tm: time.Now().UnixNano(),
+				Ss: event.Ss,
+				Rp: m.Reply,
+				Dt: nil,
+			})
+		}
+		return
+	}
+	// the events acknowledged were dropped when the event was accepted
+	replay := connect.Replay()
+	m.Next.Lock()
+	for _, event := range replay {
+		m.Next.Push(event)
+	}
+	m.Next.Unlock()
+	if request {
+		m.SendResume(connect, ResumeReply)
+	}
+	L.Infof("conn resumed, %v events retransmitted!", len(replay))
+}
+
+// SendShutdown tells the peer of connect that the conn is read to its end, it tells if the conn
+// is done both ways.
+func (m *TcpRegistry) SendShutdown(connect *Connect) bool {
+	m.send(connect.Stamp(&Event{
+		Nm: "TcpShutdown",
+		To: connect.To,
+		Fm: connect.From,
+		Tm: time.Now().UnixNano(),
+		Rp: m.Reply,
+		Dt: nil,
+	}))
+	return connect.CloseRead()
+}
+
+// Linger waits until connect, read to its end, is done both ways. The conn is closed once its
+// peer wrote nothing to it for ShutdownTimeout, a peer that never finishes does not hold it.
+func (m *TcpRegistry) Linger(connect *Connect) {
+	timeout := time.Millisecond * time.Duration(m.ShutdownTimeout)
+	if m.ShutdownTimeout <= 0 {
+		timeout = time.Millisecond * DefaultShutdownTimeout
+	}
+	connect.Touch()
+	ticker := time.NewTicker(timeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-connect.Context.Done():
+			return
+		case <-ticker.C:
+			if connect.Idle(timeout) {
+				m.Logger.WithField("TcpFrom", connect.From).Info("half closed conn is idle, close it!")
+				connect.Close()
+				return
+			}
+		}
+	}
+}
+
+func (m *TcpRegistry) HandleShutdownEvent(event *Event) {
+	L := m.Logger.WithField("TcpFrom", event.Fm).WithField("TcpTo", event.To)
+	L.Debug("shutdown event received!")
+	connect, exist := m.Find(event.To)
+	if !exist {
+		L.Debug("cannot find conn in registry")
+		return
+	}
+	// process event once the data before it is written
+	m.Deliver(connect, event)
+}
+
+func (m *TcpRegistry) HandleCloseEvent(event *Event) {
+	L := m.Logger.WithField("TcpFrom", event.Fm).WithField("TcpTo", event.To)
+	L.Debug("close event received!")
+	connect, exist := m.Find(event.To)
+	if !exist {
+		L.Debug("cannot find conn in registry")
+		return
+	}
+	// process event once the data before it is written
+	m.Deliver(connect, event)
+}
@@ -0,0 +1,35 @@
+package euphoria
+
+import (
+	"github.com/sirupsen/logrus"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTcpRegistryWrite(t *testing.T) {
+	registry := &TcpRegistry{Logger: logrus.WithField("Fm", "TcpRegistry"), Next: &EventQueueImpl{}, Window: WindowSize(0)}
+	conn, peer := net.Pipe()
+	connect := NewConnect(conn, "foo", "bar")
+	done := make(chan struct{})
+	go func() {
+		registry.Write(connect)
+		close(done)
+	}()
+	// a failed write closes the conn and drops the events left
+	peer.Close()
+	registry.Deliver(connect, &Event{Nm: "TcpData", Dt: []byte("a")})
+	registry.Deliver(connect, &Event{Nm: "TcpData", Dt: []byte("b")})
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("writer is not done after a failed write")
+	}
+	if connect.Context.Err() == nil {
+		t.Fatal("conn is not closed after a failed write")
+	}
+	registry.Deliver(connect, &Event{Nm: "TcpData", Dt: []byte("c")})
+	if count := connect.Writes.Count(); count != 0 {
+		t.Fatalf("%v events left to write", count)
+	}
+}
@@ -0,0 +1,179 @@
+package euphoria
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+var ErrTlsFilesMissing = errors.New("self-signed certificate needs CertFile and KeyFile")
+
+type TlsServerConfig struct {
+	CertFile     string   `yaml:"CertFile"`
+	KeyFile      string   `yaml:"KeyFile"`
+	ClientCaFile string   `yaml:"ClientCaFile"`
+	SelfSigned   bool     `yaml:"SelfSigned"`
+	Hosts        []string `yaml:"Hosts"`
+}
+
+type TlsClientConfig struct {
+	CaFile     string `yaml:"CaFile"`
+	CertFile   string `yaml:"CertFile"`
+	KeyFile    string `yaml:"KeyFile"`
+	ServerName string `yaml:"ServerName"`
+	PinSha256  string `yaml:"PinSha256"`
+}
+
+// NewServerTlsConfig makes the tls config of the server listener, it returns nil if no
+// certificate is configured. With SelfSigned a certificate is generated on first run, at
+// CertFile and KeyFile which must then be given.
+func NewServerTlsConfig(config *TlsServerConfig) (*tls.Config, error) {
+	if config.CertFile == "" || config.KeyFile == "" {
+		if config.SelfSigned {
+			return nil, ErrTlsFilesMissing
+		}
+		return nil, nil
+	}
+	L := logrus.WithField("Fm", "NewServerTlsConfig")
+	if config.SelfSigned {
+		if _, err := os.Stat(config.CertFile); os.IsNotExist(err) {
+			L.Infof("generate self-signed certificate %v", config.CertFile)
+			err = GenerateCertificate(config.CertFile, config.KeyFile, config.Hosts)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	L.Infof("certificate sha256: %v", CertificateSha256(cert.Certificate[0]))
+	tlsConfig := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+	// verify client certificates
+	if config.ClientCaFile != "" {
+		pool, err := LoadCertPool(config.ClientCaFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// NewClientTlsConfig makes the tls config of the client, it returns nil if nothing is configured.
+// With PinSha256 the server is trusted by the sha256 of its certificate instead of a ca, with
+// both the chain is verified against the ca and the certificate must match the pin.
+func NewClientTlsConfig(config *TlsClientConfig) (*tls.Config, error) {
+	if *config == (TlsClientConfig{}) {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: config.ServerName,
+	}
+	if config.CaFile != "" {
+		pool, err := LoadCertPool(config.CaFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if config.CertFile != "" || config.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if config.PinSha256 != "" {
+		pin := strings.ToLower(strings.ReplaceAll(config.PinSha256, ":", ""))
+		// the pin replaces the chain verification only if no ca is given
+		tlsConfig.InsecureSkipVerify = config.CaFile == ""
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 || CertificateSha256(rawCerts[0]) != pin {
+				return errors.New("server certificate does not match the pin")
+			}
+			return nil
+		}
+	}
+	return tlsConfig, nil
+}
+
+// LoadCertPool loads the pem certificates in file.
+func LoadCertPool(file string) (*x509.CertPool, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, errors.New("no certificate found in " + file)
+	}
+	return pool, nil
+}
+
+// CertificateSha256 is the hex sha256 of a der certificate, used as pin.
+func CertificateSha256(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// GenerateCertificate writes a self-signed certificate for hosts and its key as pem files.
+func GenerateCertificate(certFile string, keyFile string, hosts []string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "euphoria"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
@@ -0,0 +1,64 @@
+package euphoria
+
+import (
+	"crypto/tls"
+	"path/filepath"
+	"testing"
+)
+
+func TestTlsPin(t *testing.T) {
+	// self-signed needs the files to write the certificate to
+	if _, err := NewServerTlsConfig(&TlsServerConfig{SelfSigned: true}); err != ErrTlsFilesMissing {
+		t.Fatalf("self-signed without files: %v", err)
+	}
+	dir := t.TempDir()
+	serverConfig, err := NewServerTlsConfig(&TlsServerConfig{
+		CertFile:   filepath.Join(dir, "cert.pem"),
+		KeyFile:    filepath.Join(dir, "key.pem"),
+		SelfSigned: true,
+		Hosts:      []string{"127.0.0.1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_ = conn.(*tls.Conn).Handshake()
+				conn.Close()
+			}()
+		}
+	}()
+	handshake := func(pin string) error {
+		clientConfig, err := NewClientTlsConfig(&TlsClientConfig{PinSha256: pin})
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := tls.Dial("tcp", listener.Addr().String(), clientConfig)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	// the server is trusted by the pin of its certificate only
+	pin := CertificateSha256(serverConfig.Certificates[0].Certificate[0])
+	if err = handshake(pin); err != nil {
+		t.Fatalf("pinned certificate refused: %v", err)
+	}
+	if err = handshake(CertificateSha256(nil)); err == nil {
+		t.Fatal("certificate not matching the pin accepted")
+	}
+	// without a pin or a ca the self-signed certificate is not trusted
+	if _, err = tls.Dial("tcp", listener.Addr().String(), &tls.Config{}); err == nil {
+		t.Fatal("self-signed certificate accepted")
+	}
+}
@@ -0,0 +1,44 @@
+package euphoria
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// UdpFlow is the datagrams exchanged between a local address and a remote one, it stands
+// in for a conn as udp has none.
+type UdpFlow struct {
+	Conn     net.PacketConn
+	Addr     net.Addr // address the datagrams of the flow are written to
+	From     string
+	To       string
+	Session  string
+	LastSeen int64 // unix nano of the last datagram
+}
+
+func NewUdpFlow(conn net.PacketConn, addr net.Addr, from string, to string) *UdpFlow {
+	return &UdpFlow{
+		Conn:     conn,
+		Addr:     addr,
+		From:     from,
+		To:       to,
+		Session:  "",
+		LastSeen: time.Now().UnixNano(),
+	}
+}
+
+// Touch marks the flow as active.
+func (m *UdpFlow) Touch() {
+	atomic.StoreInt64(&m.LastSeen, time.Now().UnixNano())
+}
+
+// Key is the local and the remote address of the flow, it tells the flows of a socket apart.
+func (m *UdpFlow) Key() string {
+	return m.Conn.LocalAddr().String() + "/" + m.Addr.String()
+}
+
+// Idle tells if the flow saw no datagram for timeout.
+func (m *UdpFlow) Idle(timeout time.Duration) bool {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&m.LastSeen))) > timeout
+}
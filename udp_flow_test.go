@@ -0,0 +1,87 @@
+package euphoria
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUdpFlow(t *testing.T) {
+	dest, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dest.Close()
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := dest.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = dest.WriteTo(buf[:n], addr)
+		}
+	}()
+	// the input talks to the output through the queues of the transport
+	inputOut := &EventQueueImpl{}
+	outputOut := &EventQueueImpl{}
+	input := NewUdpInput(&UdpInputConfig{
+		Tunnels:        []UdpTunnelConfig{{Name: "echo", ListenAddr: "127.0.0.1:0"}},
+		ReadBufferSize: 2048,
+		FlowTimeout:    100,
+	}, inputOut)
+	output := NewUdpOutput(&UdpOutputConfig{
+		Destinations:   map[string]string{"echo": dest.LocalAddr().String()},
+		ReadBufferSize: 2048,
+		FlowTimeout:    100,
+	}, outputOut)
+	go input.Run()
+	go output.Run()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go pump(ctx, inputOut, output)
+	go pump(ctx, outputOut, input)
+	tunnel := input.Tunnels[0].Conn.LocalAddr()
+	echo := func(conn net.PacketConn, data string) {
+		if _, err := conn.WriteTo([]byte(data), tunnel); err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, 2048)
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil || string(buf[:n]) != data || addr.String() != tunnel.String() {
+			t.Fatalf("invalid echo %q from %v: %v", buf[:n], addr, err)
+		}
+	}
+	flows := func() (int, int) {
+		input.RegistryMutex.Lock()
+		inputs := len(input.Registry)
+		input.RegistryMutex.Unlock()
+		output.RegistryMutex.Lock()
+		outputs := len(output.Registry)
+		output.RegistryMutex.Unlock()
+		return inputs, outputs
+	}
+	// each source address is a flow of its own
+	a, _ := net.ListenPacket("udp", "127.0.0.1:0")
+	defer a.Close()
+	b, _ := net.ListenPacket("udp", "127.0.0.1:0")
+	defer b.Close()
+	echo(a, "foo")
+	echo(b, "bar")
+	echo(a, "baz")
+	if inputs, outputs := flows(); inputs != 2 || outputs != 2 {
+		t.Fatalf("%v input and %v output flows, expect 2", inputs, outputs)
+	}
+	// idle flows expire on both sides
+	deadline := time.Now().Add(time.Second)
+	for inputs, outputs := flows(); inputs != 0 || outputs != 0; inputs, outputs = flows() {
+		if time.Now().After(deadline) {
+			t.Fatalf("%v input and %v output flows left", inputs, outputs)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// and are opened again by the next datagram
+	echo(a, "qux")
+}
@@ -0,0 +1,255 @@
+package euphoria
+
+import (
+	"context"
+	"github.com/sirupsen/logrus"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+type UdpInputConfig struct {
+	Tunnels        []UdpTunnelConfig `yaml:"Tunnels"`
+	ReadBufferSize int               `yaml:"ReadBufferSize"`
+	FlowTimeout    int               `yaml:"FlowTimeout"`
+	QueueLimit     EventQueueLimit   `yaml:"QueueLimit"`
+	QueueLog       EventLogConfig    `yaml:"QueueLog"`
+}
+
+// UdpTunnelConfig is a local listen address whose flows are sent to the destination called
+// Name on the other side. Session is the client session a tunnel listening on the server
+// is opened through.
+type UdpTunnelConfig struct {
+	Name       string `yaml:"Name"`
+	ListenAddr string `yaml:"ListenAddr"`
+	Session    string `yaml:"Session"`
+}
+
+type UdpTunnel struct {
+	Config *UdpTunnelConfig
+	Conn   net.PacketConn
+}
+
+// UdpInput maps the datagrams received by its tunnels to flows by their source address, a flow
+// is opened on the other side by its first datagram and closed once it is idle. The other side
+// knows a flow by its session and From, so events of the input have no To.
+type UdpInput struct {
+	EventQueueImpl
+	Config        *UdpInputConfig
+	Logger        *logrus.Entry
+	Tunnels       []*UdpTunnel
+	Registry      map[string]*UdpFlow // flows by id
+	Addrs         map[string]*UdpFlow // flows by local and source address
+	RegistryMutex sync.Mutex
+	Next          EventQueue
+}
+
+func NewUdpInput(config *UdpInputConfig, next EventQueue) *UdpInput {
+	// setup logger
+	L := logrus.WithField("Fm", "NewUdpInput")
+	// create instance
+	udpInput := &UdpInput{
+		EventQueueImpl: EventQueueImpl{Limit: config.QueueLimit},
+		Config:         config,
+		Logger:         logrus.WithField("Fm", "UdpInput"),
+		Tunnels:        nil,
+		Registry:       make(map[string]*UdpFlow),
+		Addrs:          make(map[string]*UdpFlow),
+		RegistryMutex:  sync.Mutex{},
+		Next:           next,
+	}
+	if err := udpInput.OpenLog(&config.QueueLog, "udp-input"); err != nil {
+		L.WithError(err).Fatalln("failed to open queue log!")
+	}
+	// create listeners
+	for i := range config.Tunnels {
+		conn, err := net.ListenPacket("udp", config.Tunnels[i].ListenAddr)
+		if err != nil {
+			L.WithError(err).Fatalln("failed to do udp listen!")
+		}
+		udpInput.Tunnels = append(udpInput.Tunnels, &UdpTunnel{
+			Config: &config.Tunnels[i],
+			Conn:   conn,
+		})
+	}
+	return udpInput
+}
+
+func (m *UdpInput) Run() {
+	for _, tunnel := range m.Tunnels {
+		go m.Poll(tunnel)
+	}
+	go m.Expire()
+	m.HandleEvents()
+}
+
+// Poll reads the datagrams of tunnel and sends each of them as a data event of its flow.
+func (m *UdpInput) Poll(tunnel *UdpTunnel) {
+	m.Logger.Infof("udp tunnel %q listen at: %v", tunnel.Config.Name, tunnel.Config.ListenAddr)
+	buf := make([]byte, m.Config.ReadBufferSize)
+	for {
+		n, addr, err := tunnel.Conn.ReadFrom(buf)
+		if err != nil {
+			if strings.Contains(err.Error(), "use of closed network connection") {
+				return
+			}
+			m.Logger.WithError(err).Errorln("failed to read udp conn!")
+			continue
+		}
+		datagram := make([]byte, n)
+		copy(datagram, buf[:n])
+		flow := m.Flow(tunnel, addr)
+		flow.Touch()
+		// datagrams are dropped while the next queue is full
+		m.Next.Lock()
+		full := m.Next.Full(flow.Session, flow.From)
+		if !full {
+			m.Next.Push(&Event{
+				Nm: "UdpData",
+				To: "",
+				Fm: flow.From,
+				Tm: time.Now().UnixNano(),
+				Ss: flow.Session,
+				Dt: datagram,
+			})
+		}
+		m.Next.Unlock()
+		if full {
+			m.Logger.Debugf("queue full, drop datagram of flow %v", flow.From)
+		}
+	}
+}
+
+// Flow returns the flow of addr on tunnel, a new flow is registered and opened if it does not exist yet.
+func (m *UdpInput) Flow(tunnel *UdpTunnel, addr net.Addr) *UdpFlow {
+	key := tunnel.Conn.LocalAddr().String() + "/" + addr.String()
+	m.RegistryMutex.Lock()
+	defer m.RegistryMutex.Unlock()
+	flow, exist := m.Addrs[key]
+	if exist {
+		return flow
+	}
+	flow = NewUdpFlow(tunnel.Conn, addr, NewConnectId(), "")
+	flow.Session = tunnel.Config.Session
+	m.Registry[flow.From] = flow
+	m.Addrs[key] = flow
+	m.Logger.WithField("Alive", len(m.Registry)).Infof("flow %v of %v opened to %q!", flow.From, addr, tunnel.Config.Name)
+	// send open event, it carries the destination name of the tunnel
+	m.Next.Lock()
+	m.Next.Push(&Event{
+		Nm: "UdpOpen",
+		To: "",
+		Fm: flow.From,
+		Tm: time.Now().UnixNano(),
+		Ss: flow.Session,
+		Dt: []byte(tunnel.Config.Name),
+	})
+	m.Next.Unlock()
+	return flow
+}
+
+// Expire closes the flows idle for FlowTimeout, flows never expire if it is 0.
+func (m *UdpInput) Expire() {
+	timeout := time.Millisecond * time.Duration(m.Config.FlowTimeout)
+	if timeout <= 0 {
+		return
+	}
+	for {
+		time.Sleep(timeout / 2)
+		m.RegistryMutex.Lock()
+		for _, flow := range m.Registry {
+			if !flow.Idle(timeout) {
+				continue
+			}
+			m.remove(flow)
+			m.Next.Lock()
+			m.Next.Push(&Event{
+				Nm: "UdpClose",
+				To: "",
+				Fm: flow.From,
+				Tm: time.Now().UnixNano(),
+				Ss: flow.Session,
+				Dt: nil,
+			})
+			m.Next.Unlock()
+			m.Logger.WithField("Alive", len(m.Registry)).Infof("flow %v expired!", flow.From)
+		}
+		m.RegistryMutex.Unlock()
+	}
+}
+
+// CloseSession drops every flow opened on behalf of session.
+func (m *UdpInput) CloseSession(session string) {
+	m.RegistryMutex.Lock()
+	defer m.RegistryMutex.Unlock()
+	for _, flow := range m.Registry {
+		if flow.Session == session {
+			m.remove(flow)
+		}
+	}
+}
+
+// remove drops flow from the registry, it is called with the registry lock held.
+func (m *UdpInput) remove(flow *UdpFlow) {
+	delete(m.Registry, flow.From)
+	delete(m.Addrs, flow.Key())
+}
+
+func (m *UdpInput) HandleEvents() {
+	for m.Wait(context.Background()) {
+		// get events
+		m.Lock()
+		events := m.Drain()
+		m.Unlock()
+		// process events
+		for _, event := range events {
+			switch event.Nm {
+			case "UdpData":
+				m.HandleDataEvent(event)
+			case "UdpClose":
+				m.HandleCloseEvent(event)
+			default:
+				m.Logger.Errorf("invalid event type: %v", event.Nm)
+			}
+		}
+	}
+}
+
+// lookup finds the flow an event of the other side is sent to.
+func (m *UdpInput) lookup(event *Event) *UdpFlow {
+	m.RegistryMutex.Lock()
+	defer m.RegistryMutex.Unlock()
+	flow, exist := m.Registry[event.To]
+	if !exist || (flow.Session != "" && flow.Session != event.Ss) {
+		return nil
+	}
+	return flow
+}
+
+func (m *UdpInput) HandleDataEvent(event *Event) {
+	L := m.Logger.WithField("UdpFrom", event.Fm).WithField("UdpTo", event.To)
+	flow := m.lookup(event)
+	if flow == nil {
+		L.Debug("cannot find flow in registry")
+		return
+	}
+	flow.Touch()
+	_, err := flow.Conn.WriteTo(event.Dt, flow.Addr)
+	if err != nil {
+		L.WithError(err).Error("failed to write udp conn!")
+	}
+}
+
+func (m *UdpInput) HandleCloseEvent(event *Event) {
+	L := m.Logger.WithField("UdpFrom", event.Fm).WithField("UdpTo", event.To)
+	L.Debug("close event received!")
+	flow := m.lookup(event)
+	if flow == nil {
+		L.Debug("cannot find flow in registry")
+		return
+	}
+	m.RegistryMutex.Lock()
+	m.remove(flow)
+	m.RegistryMutex.Unlock()
+}
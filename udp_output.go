@@ -0,0 +1,235 @@
+package euphoria
+
+import (
+	"context"
+	"github.com/sirupsen/logrus"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+type UdpOutputConfig struct {
+	Destinations   map[string]string `yaml:"Destinations"`
+	ReadBufferSize int               `yaml:"ReadBufferSize"`
+	FlowTimeout    int               `yaml:"FlowTimeout"`
+	QueueLimit     EventQueueLimit   `yaml:"QueueLimit"`
+	QueueLog       EventLogConfig    `yaml:"QueueLog"`
+}
+
+// UdpOutput sends the datagrams of each flow opened by the other side from a socket of its own,
+// and sends the datagrams the destination replies with back to the flow.
+type UdpOutput struct {
+	EventQueueImpl
+	Config        *UdpOutputConfig
+	Logger        *logrus.Entry
+	Registry      map[string]*UdpFlow // flows by id
+	Remotes       map[string]*UdpFlow // flows by session and id of the remote flow
+	RegistryMutex sync.Mutex
+	Next          EventQueue
+}
+
+func NewUdpOutput(config *UdpOutputConfig, next EventQueue) *UdpOutput {
+	udpOutput := &UdpOutput{
+		EventQueueImpl: EventQueueImpl{Limit: config.QueueLimit},
+		Config:         config,
+		Logger:         logrus.WithField("Fm", "UdpOutput"),
+		Registry:       make(map[string]*UdpFlow),
+		Remotes:        make(map[string]*UdpFlow),
+		RegistryMutex:  sync.Mutex{},
+		Next:           next,
+	}
+	if err := udpOutput.OpenLog(&config.QueueLog, "udp-output"); err != nil {
+		logrus.WithField("Fm", "NewUdpOutput").WithError(err).Fatalln("failed to open queue log!")
+	}
+	return udpOutput
+}
+
+func (m *UdpOutput) Run() {
+	go m.Expire()
+	for {
+		m.Update()
+	}
+}
+
+func (m *UdpOutput) Update() {
+	// wait for events
+	if !m.Wait(context.Background()) {
+		return
+	}
+	m.Lock()
+	events := m.Drain()
+	m.Unlock()
+	// process events
+	for _, event := range events {
+		switch event.Nm {
+		case "UdpOpen":
+			m.HandleOpenEvent(event)
+		case "UdpData":
+			m.HandleDataEvent(event)
+		case "UdpClose":
+			m.HandleCloseEvent(event)
+		default:
+			m.Logger.Errorf("invalid event type: %v", event.Nm)
+		}
+	}
+}
+
+// Lookup finds the flow opened on behalf of the remote flow from of session.
+func (m *UdpOutput) Lookup(session string, from string) *UdpFlow {
+	m.RegistryMutex.Lock()
+	defer m.RegistryMutex.Unlock()
+	return m.Remotes[session+"/"+from]
+}
+
+// Expire closes the flows idle for FlowTimeout, flows never expire if it is 0.
+func (m *UdpOutput) Expire() {
+	timeout := time.Millisecond * time.Duration(m.Config.FlowTimeout)
+	if timeout <= 0 {
+		return
+	}
+	for {
+		time.Sleep(timeout / 2)
+		m.RegistryMutex.Lock()
+		for _, flow := range m.Registry {
+			if flow.Idle(timeout) {
+				flow.Conn.Close()
+			}
+		}
+		m.RegistryMutex.Unlock()
+	}
+}
+
+// CloseSession closes every flow opened on behalf of session.
+func (m *UdpOutput) CloseSession(session string) {
+	m.RegistryMutex.Lock()
+	defer m.RegistryMutex.Unlock()
+	for _, flow := range m.Registry {
+		if flow.Session == session {
+			flow.Conn.Close()
+		}
+	}
+}
+
+func (m *UdpOutput) Poll(flow *UdpFlow) {
+	defer func() {
+		flow.Conn.Close()
+		// remove from registry
+		m.RegistryMutex.Lock()
+		defer m.RegistryMutex.Unlock()
+		delete(m.Registry, flow.From)
+		if m.Remotes[flow.Session+"/"+flow.To] == flow {
+			delete(m.Remotes, flow.Session+"/"+flow.To)
+		}
+		// send close event
+		m.Next.Lock()
+		m.Next.Push(&Event{
+			Nm: "UdpClose",
+			To: flow.To,
+			Fm: flow.From,
+			Tm: time.Now().UnixNano(),
+			Ss: flow.Session,
+			Rp: true,
+			Dt: nil,
+		})
+		m.Next.Unlock()
+		m.Logger.WithField("Alive", len(m.Registry)).Infof("flow %v closed!", flow.To)
+	}()
+	buf := make([]byte, m.Config.ReadBufferSize)
+	for {
+		n, addr, err := flow.Conn.ReadFrom(buf)
+		if err != nil {
+			if !strings.Contains(err.Error(), "use of closed network connection") {
+				m.Logger.WithError(err).Errorln("failed to read udp conn!")
+			}
+			break
+		}
+		// only the destination may reply
+		if addr.String() != flow.Addr.String() {
+			continue
+		}
+		datagram := make([]byte, n)
+		copy(datagram, buf[:n])
+		flow.Touch()
+		// datagrams are dropped while the next queue is full
+		m.Next.Lock()
+		full := m.Next.Full(flow.Session, flow.From)
+		if !full {
+			m.Next.Push(&Event{
+				Nm: "UdpData",
+				To: flow.To,
+				Fm: flow.From,
+				Tm: time.Now().UnixNano(),
+				Ss: flow.Session,
+				Rp: true,
+				Dt: datagram,
+			})
+		}
+		m.Next.Unlock()
+		if full {
+			m.Logger.Debugf("queue full, drop datagram of flow %v", flow.From)
+		}
+	}
+}
+
+func (m *UdpOutput) HandleOpenEvent(event *Event) {
+	L := m.Logger.WithField("UdpFrom", event.Fm)
+	L.Debug("open event received!")
+	// drop duplicated open event
+	if m.Lookup(event.Ss, event.Fm) != nil {
+		L.Debug("drop duplicated open event")
+		return
+	}
+	// resolve dest
+	name := string(event.Dt)
+	dest, exist := m.Config.Destinations[name]
+	if !exist {
+		L.Errorf("unknown destination %q!", name)
+		return
+	}
+	addr, err := net.ResolveUDPAddr("udp", dest)
+	if err != nil {
+		L.WithError(err).Error("failed to resolve dest!")
+		return
+	}
+	conn, err := net.ListenPacket("udp", "")
+	if err != nil {
+		L.WithError(err).Error("failed to open udp conn!")
+		return
+	}
+	// make flow and add it to registry
+	flow := NewUdpFlow(conn, addr, NewConnectId(), event.Fm)
+	flow.Session = event.Ss
+	m.RegistryMutex.Lock()
+	m.Registry[flow.From] = flow
+	m.Remotes[flow.Session+"/"+flow.To] = flow
+	alive := len(m.Registry)
+	m.RegistryMutex.Unlock()
+	m.Logger.WithField("Alive", alive).Infof("flow %v opened to %v!", event.Fm, dest)
+	go m.Poll(flow)
+}
+
+func (m *UdpOutput) HandleDataEvent(event *Event) {
+	L := m.Logger.WithField("UdpFrom", event.Fm)
+	flow := m.Lookup(event.Ss, event.Fm)
+	if flow == nil {
+		L.Debug("cannot find flow in registry!")
+		return
+	}
+	flow.Touch()
+	_, err := flow.Conn.WriteTo(event.Dt, flow.Addr)
+	if err != nil {
+		L.WithError(err).Error("failed to write udp conn!")
+	}
+}
+
+func (m *UdpOutput) HandleCloseEvent(event *Event) {
+	L := m.Logger.WithField("UdpFrom", event.Fm)
+	L.Debug("close event received!")
+	flow := m.Lookup(event.Ss, event.Fm)
+	if flow == nil {
+		L.Debug("cannot find flow in registry")
+		return
+	}
+	flow.Conn.Close()
+}
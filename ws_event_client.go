@@ -0,0 +1,235 @@
+package euphoria
+
+import (
+	"context"
+	"errors"
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrUpgradeRefused = errors.New("websocket upgrade refused")
+
+type WsEventClientConfig struct {
+	EventEncode       string `yaml:"EventEncode"`
+	BaseAddr          string `yaml:"BaseAddr"`
+	IdleInterval      int    `yaml:"IdleInterval"`
+	EventWsPath       string `yaml:"EventWsPath"`
+	SessionId         string `yaml:"SessionId"`
+	AuthToken         string `yaml:"AuthToken"`
+	SchedulerQuantum  int    `yaml:"SchedulerQuantum"`
+	MaxEventPostSize  int    `yaml:"MaxEventPostSize"`
+	MaxEventPostBytes int    `yaml:"MaxEventPostBytes"`
+	KeepAlive         int    `yaml:"KeepAlive"`
+}
+
+// WsEventClient carries the events of the client over a websocket, it sends the events
+// queued in Source and pushes the events received to Next.
+type WsEventClient struct {
+	Config    *WsEventClientConfig
+	Logger    *logrus.Entry
+	Dialer    *websocket.Dialer
+	Source    EventQueue
+	Next      EventQueue
+	Cursor    *EventCursor
+	Cipher    *EventCipher
+	Scheduler *EventScheduler
+	Epoch     *EventEpoch // tells the conns when the server restarted, nil if nobody cares
+}
+
+func NewWsEventClient(config *WsEventClientConfig, client *http.Client, source EventQueue, next EventQueue, cipher *EventCipher) *WsEventClient {
+	dialer := *websocket.DefaultDialer
+	if transport, ok := client.Transport.(*http.Transport); ok {
+		dialer.TLSClientConfig = transport.TLSClientConfig
+	}
+	return &WsEventClient{
+		Config:    config,
+		Logger:    logrus.WithField("Fm", "WsEventClient"),
+		Dialer:    &dialer,
+		Source:    source,
+		Next:      next,
+		Cursor:    &EventCursor{},
+		Cipher:    cipher,
+		Scheduler: NewEventScheduler(config.SchedulerQuantum, config.EventEncode),
+	}
+}
+
+// UpgradeRefused tells if the status of a failed dial means websockets are not supported,
+// other statuses may be transient and the dial is retried.
+func UpgradeRefused(code int) bool {
+	switch code {
+	case http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusUpgradeRequired:
+		return true
+	default:
+		return false
+	}
+}
+
+// WsKeepAlive pings conn every keepAlive ms until ctx is done, conn fails to read once the peer
+// has not been heard of, not even a ping or a pong, for twice as long. It must be called before
+// conn is read, nothing is done if keepAlive is not positive.
+func WsKeepAlive(ctx context.Context, conn *websocket.Conn, keepAlive int) {
+	if keepAlive <= 0 {
+		return
+	}
+	interval := time.Millisecond * time.Duration(keepAlive)
+	extend := func() {
+		_ = conn.SetReadDeadline(time.Now().Add(2 * interval))
+	}
+	extend()
+	conn.SetPongHandler(func(string) error {
+		extend()
+		return nil
+	})
+	conn.SetPingHandler(func(data string) error {
+		extend()
+		err := conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(interval))
+		if err == websocket.ErrCloseSent {
+			return nil
+		}
+		return err
+	})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(interval))
+			if err != nil {
+				return
+			}
+		}
+	}()
+}
+
+func (m *WsEventClient) Idle() {
+	time.Sleep(time.Millisecond * time.Duration(m.Config.IdleInterval))
+}
+
+// Url is the websocket url of the event endpoint.
+func (m *WsEventClient) Url() string {
+	url := m.Config.BaseAddr + m.Config.EventWsPath
+	if strings.HasPrefix(url, "https://") {
+		return "wss://" + strings.TrimPrefix(url, "https://")
+	}
+	return "ws://" + strings.TrimPrefix(url, "http://")
+}
+
+// Run keeps a websocket to the server, it only returns ErrUpgradeRefused when the
+// server or a proxy in between refuses the upgrade.
+func (m *WsEventClient) Run() error {
+	header := http.Header{}
+	header.Set(EventSessionHeader, m.Config.SessionId)
+	SetAuthToken(header, m.Config.AuthToken)
+	for {
+		conn, res, err := m.Dialer.Dial(m.Url(), header)
+		if err != nil {
+			if res != nil && res.StatusCode == http.StatusUnauthorized {
+				m.Logger.WithError(err).Errorln("unauthorized! retry!")
+				m.Idle()
+				continue
+			}
+			// only a server or proxy without websocket support makes the client fall back
+			if res != nil && UpgradeRefused(res.StatusCode) {
+				m.Logger.WithError(err).WithField("Code", res.StatusCode).Warn("upgrade refused!")
+				return ErrUpgradeRefused
+			}
+			m.Logger.WithError(err).Errorln("failed to dial websocket! retry!")
+			m.Idle()
+			continue
+		}
+		m.Logger.Infof("connected to %v", m.Url())
+		m.Epoch.Observe(res.Header.Get(EventEpochHeader))
+		// either side failing ends the conn
+		wg := sync.WaitGroup{}
+		wg.Add(2)
+		ctx, cancel := context.WithCancel(context.Background())
+		WsKeepAlive(ctx, conn, m.Config.KeepAlive)
+		go func() {
+			defer wg.Done()
+			m.Send(ctx, conn)
+			conn.Close()
+		}()
+		go func() {
+			defer wg.Done()
+			m.Retrieve(conn)
+			cancel()
+			conn.Close()
+		}()
+		wg.Wait()
+		m.Logger.Warn("websocket closed! reconnect!")
+		m.Idle()
+	}
+}
+
+// Send writes the events queued in Source to conn, along with the ack of the last batch received,
+// until ctx is done.
+func (m *WsEventClient) Send(ctx context.Context, conn *websocket.Conn) {
+	var acked uint64
+	for {
+		// get events
+		// take a fair batch, the events left wait for the next frame
+		m.Source.Lock()
+		events, rest := m.Scheduler.Schedule(m.Source.Drain(), m.Config.MaxEventPostSize, MaxBatchBytes(m.Config.MaxEventPostBytes))
+		m.Source.Recovery(rest)
+		m.Source.Unlock()
+		cursor := m.Cursor.Load()
+		if len(events) == 0 && cursor == acked {
+			if !m.Cursor.Wait(ctx, m.Source, acked) {
+				return
+			}
+			continue
+		}
+		// send frame
+		b, err := m.Cipher.Encode(m.Config.EventEncode, m.Config.SessionId, &EventFrame{Ck: cursor, Ev: events})
+		if err != nil {
+			m.Logger.WithError(err).Error("invalid event encoding")
+			return
+		}
+		err = conn.WriteMessage(websocket.BinaryMessage, b)
+		if err != nil {
+			m.Logger.WithError(err).Errorln("failed to write conn, do recovery!")
+			m.Source.Lock()
+			m.Source.Recovery(events)
+			m.Source.Unlock()
+			return
+		}
+		acked = cursor
+	}
+}
+
+// Retrieve pushes the events read from conn to Next, dropping batches already received.
+func (m *WsEventClient) Retrieve(conn *websocket.Conn) {
+	for {
+		_, b, err := conn.ReadMessage()
+		if err != nil {
+			m.Logger.WithError(err).Errorln("failed to read conn!")
+			return
+		}
+		var frame EventFrame
+		err = m.Cipher.Decode(m.Config.EventEncode, m.Config.SessionId, b, &frame)
+		if err != nil {
+			m.Logger.WithError(err).Errorln("failed to decode frame, rejected!")
+			return
+		}
+		if frame.Ck <= m.Cursor.Load() {
+			m.Logger.Debugf("drop re-delivered batch %v", frame.Ck)
+			continue
+		}
+		m.Next.WaitSpace(context.Background(), "", "")
+		m.Next.Lock()
+		for _, event := range frame.Ev {
+			m.Next.Push(event)
+		}
+		m.Next.Unlock()
+		// wake up the sender to ack
+		m.Cursor.Store(frame.Ck)
+	}
+}
@@ -0,0 +1,174 @@
+package euphoria
+
+import (
+	"context"
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type WsEventEndpointConfig struct {
+	EventEncode string   `yaml:"EventEncode"`
+	BasePath    string   `yaml:"BasePath"`
+	EventWsPath string   `yaml:"EventWsPath"`
+	AuthTokens  []string `yaml:"AuthTokens"`
+	KeepAlive   int      `yaml:"KeepAlive"`
+}
+
+// WsEventEndpoint carries the events of a session over a websocket, events from the client
+// go to Next and events for the client are taken from the provider.
+type WsEventEndpoint struct {
+	Config     *WsEventEndpointConfig
+	Logger     *logrus.Entry
+	HttpServer *http.ServeMux
+	Upgrader   *websocket.Upgrader
+	Provider   *HttpEventProvider
+	Next       EventQueue
+	Cipher     *EventCipher
+	Handlers   map[string]*WsEventHandler // the handler of each session, a new conn replaces it
+	mutex      sync.Mutex
+}
+
+// WsEventHandler is the handler serving the conn of a session.
+type WsEventHandler struct {
+	Stop func()
+	Done chan struct{}
+}
+
+func NewWsEventEndpoint(config *WsEventEndpointConfig, httpServer *http.ServeMux, provider *HttpEventProvider, next EventQueue, cipher *EventCipher) *WsEventEndpoint {
+	endpoint := &WsEventEndpoint{
+		Config:     config,
+		Logger:     logrus.WithField("Fm", "WsEventEndpoint"),
+		HttpServer: httpServer,
+		Upgrader: &websocket.Upgrader{
+			// the client is not a browser
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+		Provider: provider,
+		Next:     next,
+		Cipher:   cipher,
+		Handlers: make(map[string]*WsEventHandler),
+	}
+	endpoint.SetupHandler()
+	return endpoint
+}
+
+func (m *WsEventEndpoint) SetupHandler() {
+	if m.Config.EventWsPath == "" {
+		return
+	}
+	m.HttpServer.HandleFunc(m.Config.BasePath+m.Config.EventWsPath, Authenticate(m.Config.AuthTokens, m.HttpEventWsHandler()))
+}
+
+func (m *WsEventEndpoint) HttpEventWsHandler() http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		id := request.Header.Get(EventSessionHeader)
+		header := http.Header{}
+		header.Set(EventEpochHeader, m.Provider.Epoch)
+		conn, err := m.Upgrader.Upgrade(writer, request, header)
+		if err != nil {
+			m.Logger.WithError(err).Errorln("failed to upgrade conn!")
+			return
+		}
+		defer conn.Close()
+		m.Logger.Infof("session %v connected!", id)
+		ctx, cancel := context.WithCancel(request.Context())
+		defer cancel()
+		// the conn replaces the one the session had, both would take the batches of the session
+		handler := &WsEventHandler{
+			Stop: func() {
+				cancel()
+				conn.Close()
+			},
+			Done: make(chan struct{}),
+		}
+		defer close(handler.Done)
+		m.mutex.Lock()
+		previous := m.Handlers[id]
+		m.Handlers[id] = handler
+		m.mutex.Unlock()
+		defer func() {
+			m.mutex.Lock()
+			if m.Handlers[id] == handler {
+				delete(m.Handlers, id)
+			}
+			m.mutex.Unlock()
+		}()
+		if previous != nil {
+			m.Logger.Warnf("session %v reconnected, close its previous conn!", id)
+			previous.Stop()
+			<-previous.Done
+		}
+		// batches lost with a previous conn are delivered first
+		m.Provider.Lock()
+		m.Provider.Session(id).Rewind()
+		m.Provider.Unlock()
+		// and the conns retransmit what was lost with it
+		m.Provider.Resume(id)
+		WsKeepAlive(ctx, conn, m.Config.KeepAlive)
+		go func() {
+			defer cancel()
+			m.Receive(conn, id)
+		}()
+		m.Send(ctx, conn, id)
+		m.Logger.Infof("session %v disconnected!", id)
+	}
+}
+
+// Receive pushes the events from conn to Next and applies the acks to the session.
+func (m *WsEventEndpoint) Receive(conn *websocket.Conn, id string) {
+	for {
+		_, b, err := conn.ReadMessage()
+		if err != nil {
+			m.Logger.WithError(err).Debug("failed to read conn!")
+			return
+		}
+		var frame EventFrame
+		err = m.Cipher.Decode(m.Config.EventEncode, id, b, &frame)
+		if err != nil {
+			m.Logger.WithError(err).Errorln("failed to decode frame, rejected!")
+			return
+		}
+		// apply ack
+		m.Provider.Lock()
+		session := m.Provider.Session(id)
+		m.Provider.Touch(session)
+		session.Acknowledge(frame.Ck)
+		m.Provider.Notify()
+		m.Provider.Unlock()
+		// send events
+		m.Next.WaitSpace(context.Background(), "", "")
+		m.Next.Lock()
+		for _, event := range frame.Ev {
+			event.Ss = id
+			m.Next.Push(event)
+		}
+		m.Next.Unlock()
+	}
+}
+
+// Send writes the batches of the session to conn until ctx is done.
+func (m *WsEventEndpoint) Send(ctx context.Context, conn *websocket.Conn, id string) {
+	for ctx.Err() == nil {
+		// the session stays alive as long as the conn
+		m.Provider.Lock()
+		m.Provider.Touch(m.Provider.Session(id))
+		m.Provider.Unlock()
+		batch := m.Provider.WaitBatch(ctx, id, time.Second, true)
+		if batch == nil {
+			continue
+		}
+		b, err := m.Cipher.Encode(m.Config.EventEncode, id, &EventFrame{Ck: batch.Cursor, Ev: batch.Events})
+		if err != nil {
+			m.Logger.WithError(err).Errorln("invalid event encoding")
+			return
+		}
+		err = conn.WriteMessage(websocket.BinaryMessage, b)
+		if err != nil {
+			m.Logger.WithError(err).Debug("failed to write conn, batch will be re-delivered!")
+			return
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package euphoria
+
+import (
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWsEventEndpoint(t *testing.T) {
+	provider := newTestProvider(&HttpEventProviderConfig{})
+	endpoint := NewWsEventEndpoint(&WsEventEndpointConfig{
+		EventEncode: provider.Config.EventEncode,
+		EventWsPath: "/ws",
+		KeepAlive:   50,
+	}, provider.HttpServer, provider, &EventQueueImpl{}, nil)
+	server := httptest.NewServer(endpoint.HttpServer)
+	defer server.Close()
+	dial := func(session string) *websocket.Conn {
+		header := http.Header{}
+		header.Set(EventSessionHeader, session)
+		conn, _, err := websocket.DefaultDialer.Dial("ws://"+strings.TrimPrefix(server.URL, "http://")+"/ws", header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	closed := func(conn *websocket.Conn) bool {
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return !strings.Contains(err.Error(), "timeout")
+			}
+		}
+	}
+	// a new conn of the session closes the previous one
+	a := dial("x")
+	defer a.Close()
+	b := dial("x")
+	defer b.Close()
+	if !closed(a) {
+		t.Fatal("previous conn of the session is not closed")
+	}
+	// pings answered keep a conn alive, a peer not heard of is given up
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		provider.Lock()
+		provider.Push(&Event{Nm: "a", Ss: "x"})
+		provider.Unlock()
+	}()
+	_ = b.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := b.ReadMessage(); err != nil {
+		t.Fatalf("conn answering pings is closed: %v", err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if !closed(b) {
+		t.Fatal("silent conn is not closed")
+	}
+}